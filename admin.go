@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdmin only lets through requests carrying "Authorization: Bearer <ADMIN_TOKEN>",
+// admin endpoints stay locked when ADMIN_TOKEN is not set
+func requireAdmin(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := cfg.AdminToken
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// secretSettings are the Config fields effectiveConfig only reports the presence of
+var secretSettings = map[string]bool{"AdminToken": true, "OpenAIAPIKey": true, "WebhookSecret": true}
+
+// effectiveConfig renders the configuration for /api/admin/config. Secrets become "<name>Set" flags, the
+// API keys of API_KEY_MODELS are masked, durations and time zones are written out and rules are shown as configured
+func effectiveConfig(cfg *Config) gin.H {
+	settings := gin.H{}
+	fields := reflect.ValueOf(*cfg)
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Type().Field(i).Name
+		switch value := fields.Field(i).Interface().(type) {
+		case string:
+			if secretSettings[name] {
+				settings[name+"Set"] = value != ""
+			} else {
+				settings[name] = value
+			}
+		case time.Duration:
+			settings[name] = value.String()
+		case *time.Location:
+			settings[name] = value.String()
+		case []bannedRule:
+			rules := make([]string, len(value))
+			for j, rule := range value {
+				rules[j] = rule.text
+			}
+			settings[name] = rules
+		case map[string][]string:
+			masked := make(map[string][]string, len(value))
+			for key, models := range value {
+				if key != "*" {
+					key = maskID(key)
+				}
+				masked[key] = models
+			}
+			settings[name] = masked
+		default:
+			settings[name] = value
+		}
+	}
+	return settings
+}
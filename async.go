@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// signatureHeader carries the HMAC-SHA256 of a webhook body, keyed with WEBHOOK_SECRET
+const signatureHeader = "X-Signature-256"
+
+// Async job statuses
+const (
+	JobPending   = "pending"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// AsyncChatRequestBody represents the request body for /api/chat/async
+type AsyncChatRequestBody struct {
+	ChatRequestBody
+	CallbackURL string `json:"callbackUrl"`
+}
+
+// AsyncJob is a chat completion running in the background, its result is POSTed to the callback URL
+type AsyncJob struct {
+	ID             string        `json:"id"`
+	Status         string        `json:"status"`
+	Content        string        `json:"content,omitempty"`
+	Usage          *openai.Usage `json:"usage,omitempty"`
+	Error          string        `json:"error,omitempty"`
+	ConversationID string        `json:"conversationId,omitempty"`
+	// Blocked reports that the reply matched STOP_PATTERNS and was withheld, Flagged that moderation flagged it
+	Blocked bool `json:"blocked,omitempty"`
+	Flagged bool `json:"flagged,omitempty"`
+	// Delivered reports whether the callback accepted the result
+	Delivered   bool       `json:"delivered"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// asyncJobStore keeps jobs in memory, they are lost on restart
+type asyncJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*AsyncJob
+}
+
+var asyncJobs = &asyncJobStore{jobs: make(map[string]*AsyncJob)}
+
+// add stores a new job, dropping the oldest finished job once max jobs are stored
+func (s *asyncJobStore) add(job *AsyncJob, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.jobs) >= max {
+		var oldest *AsyncJob
+		for _, j := range s.jobs {
+			if j.Status != JobPending && (oldest == nil || j.CreatedAt.Before(oldest.CreatedAt)) {
+				oldest = j
+			}
+		}
+		if oldest != nil {
+			delete(s.jobs, oldest.ID)
+		}
+	}
+	s.jobs[job.ID] = job
+}
+
+// get returns a copy of a job
+func (s *asyncJobStore) get(id string) (AsyncJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return AsyncJob{}, false
+	}
+	return *job, true
+}
+
+// update changes a job under the lock and returns a copy of the result
+func (s *asyncJobStore) update(id string, change func(job *AsyncJob)) AsyncJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.jobs[id]
+	change(job)
+	return *job
+}
+
+// asyncChatHandler handles /api/chat/async, it accepts the /api/chat body plus a callbackUrl and
+// returns a job ID right away, the completion runs in the background and is delivered to the callback
+func asyncChatHandler(client ChatClient, cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Unsigned results could be forged, so async chat is off without a secret
+		if cfg.WebhookSecret == "" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Async chat is not configured"})
+			return
+		}
+
+		var reqBody AsyncChatRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		if !validCallbackURL(reqBody.CallbackURL, cfg.WebhookAllowedHosts) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid callback URL"})
+			return
+		}
+
+		if reqBody.Candidates > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid candidates count"})
+			return
+		}
+
+		if reqBody.Variations > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "variations_not_supported"})
+			return
+		}
+
+		req, conv, ok := prepareChat(c, cfg, &reqBody.ChatRequestBody)
+		if !ok {
+			return
+		}
+		req.Stream = false
+
+		job := &AsyncJob{
+			ID:             newRequestID(),
+			Status:         JobPending,
+			ConversationID: reqBody.ConversationID,
+			CreatedAt:      time.Now(),
+		}
+		asyncJobs.add(job, cfg.MaxAsyncJobs)
+
+		fmt.Println("Started async job:", job.ID)
+		go runAsyncJob(client, cfg, job.ID, clientID(c), reqBody.SelectedFigure, reqBody.Mode, req, conv, reqBody.Messages, reqBody.CallbackURL)
+
+		c.JSON(http.StatusAccepted, gin.H{"jobId": job.ID, "status": JobPending})
+	}
+}
+
+// asyncJobHandler handles /api/chat/async/:id, reporting the status and result of a job
+func asyncJobHandler(c *gin.Context) {
+	job, ok := asyncJobs.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// runAsyncJob runs the completion of a job, records the outcome and delivers it to the callback.
+// account is the client the tokens are charged to, figure and mode are what the usage is recorded under
+func runAsyncJob(client ChatClient, cfg *Config, id string, account string, figure string, mode Mode, req openai.ChatCompletionRequest, conv *Conversation, history []Message, callbackURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.AsyncJobTimeout)
+	defer cancel()
+
+	resp, err := client.CreateChatCompletion(ctx, req)
+
+	// The reply gets the same stop patterns, redaction and moderation as a streamed one
+	var content string
+	var blocked, flagged bool
+	if err == nil && len(resp.Choices) > 0 {
+		content, blocked, flagged = reviewReply(ctx, cfg, client, id, resp.Choices[0].Message.Content)
+	}
+
+	job := asyncJobs.update(id, func(job *AsyncJob) {
+		now := time.Now()
+		job.CompletedAt = &now
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = "Error generating response"
+			if isInsufficientQuota(err) {
+				job.Error = "temporarily unavailable"
+			}
+			return
+		}
+		job.Status = JobCompleted
+		job.Usage = &resp.Usage
+		job.Content = content
+		job.Blocked = blocked
+		job.Flagged = flagged
+	})
+
+	if isInsufficientQuota(err) {
+		fmt.Println("!!! OPENAI QUOTA EXHAUSTED: requests will fail until billing is fixed:", err)
+	} else if err != nil {
+		fmt.Println("Error running async job", id+":", err)
+	} else {
+		if cfg.DailyTokenBudget > 0 {
+			dailyTokens.add(account, resp.Usage.TotalTokens)
+		}
+		recordUsage(cfg, figure, mode, req.Model, &resp.Usage)
+		if conv != nil && job.Content != "" {
+			conv.Messages = append(history, Message{Role: openai.ChatMessageRoleAssistant, Content: job.Content})
+			conversations.save(*conv, cfg.MaxConversations)
+		}
+	}
+
+	if deliverWebhook(cfg, callbackURL, job) {
+		asyncJobs.update(id, func(job *AsyncJob) { job.Delivered = true })
+	}
+}
+
+// deliverWebhook POSTs a finished job to the callback URL, signed with WEBHOOK_SECRET, retrying
+// up to WEBHOOK_ATTEMPTS times. It reports whether the callback answered with a 2xx status
+func deliverWebhook(cfg *Config, callbackURL string, job AsyncJob) bool {
+	body, err := jsonEncode(job)
+	if err != nil {
+		fmt.Println("Error encoding webhook:", err)
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	httpClient := webhookClient(cfg)
+	for attempt := 1; attempt <= cfg.WebhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * 2 * time.Second)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			fmt.Println("Error creating webhook request:", err)
+			return false
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(signatureHeader, signature)
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			fmt.Printf("Webhook for job %s failed (attempt %d): %v\n", job.ID, attempt, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			fmt.Println("Delivered webhook for job:", job.ID)
+			return true
+		}
+		fmt.Printf("Webhook for job %s failed (attempt %d): status %d\n", job.ID, attempt, resp.StatusCode)
+	}
+	return false
+}
+
+// errInternalCallback refuses a webhook connection to an address on the server's own network
+var errInternalCallback = errors.New("callback address is not public")
+
+// webhookClient is the HTTP client webhooks are delivered with. Redirects are not followed, a callback
+// could otherwise send the request anywhere. Without WEBHOOK_ALLOWED_HOSTS any host may be named, so
+// connections are only made to public addresses, checked once the host is resolved, and not through a proxy
+func webhookClient(cfg *Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(cfg.WebhookAllowedHosts) == 0 {
+		dialer := &net.Dialer{
+			Timeout: cfg.WebhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if ip := net.ParseIP(host); err != nil || ip == nil || !publicAddress(ip) {
+					return fmt.Errorf("%w: %s", errInternalCallback, address)
+				}
+				return nil
+			},
+		}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+
+	return &http.Client{
+		Timeout:   cfg.WebhookTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicAddress reports whether an IP address is reachable from the internet. Global unicast excludes
+// loopback, link-local (where cloud metadata endpoints live), multicast and unspecified addresses
+func publicAddress(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// validCallbackURL checks that a callback is an absolute http(s) URL, on one of the allowed hosts
+// (WEBHOOK_ALLOWED_HOSTS) when any are configured. Without an allowlist, localhost and non-public IP
+// addresses are refused here already, hostnames resolving to them are refused when delivering
+func validCallbackURL(raw string, allowedHosts []string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+
+	if len(allowedHosts) == 0 {
+		host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+		if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+			return false
+		}
+		if ip := net.ParseIP(host); ip != nil && !publicAddress(ip) {
+			return false
+		}
+		return true
+	}
+	for _, host := range allowedHosts {
+		if strings.EqualFold(host, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestValidCallbackURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowedHosts string
+		want         bool
+	}{
+		{"https://hooks.example.com/aristotle", "", true},
+		{"http://93.184.216.34/hook", "", true},
+		{"ftp://hooks.example.com/aristotle", "", false},
+		{"/relative/hook", "", false},
+		{"http://localhost:8080/hook", "", false},
+		{"http://api.localhost/hook", "", false},
+		{"http://127.0.0.1:4000/api/admin/config", "", false},
+		{"http://169.254.169.254/latest/meta-data/", "", false},
+		{"http://10.0.0.5/hook", "", false},
+		{"http://192.168.1.1/hook", "", false},
+		{"http://[::1]/hook", "", false},
+		{"http://[::ffff:127.0.0.1]/hook", "", false},
+		{"http://0.0.0.0/hook", "", false},
+		{"https://hooks.example.com/aristotle", "hooks.example.com", true},
+		{"https://HOOKS.example.com/aristotle", "hooks.example.com", true},
+		{"https://evil.example.com/aristotle", "hooks.example.com", false},
+		// An allowlisted internal host is the operator's choice
+		{"http://10.0.0.5/hook", "10.0.0.5", true},
+	}
+	for _, tt := range tests {
+		var allowedHosts []string
+		if tt.allowedHosts != "" {
+			allowedHosts = strings.Split(tt.allowedHosts, ",")
+		}
+		if got := validCallbackURL(tt.url, allowedHosts); got != tt.want {
+			t.Errorf("validCallbackURL(%q) with WEBHOOK_ALLOWED_HOSTS=%q = %v, want %v", tt.url, tt.allowedHosts, got, tt.want)
+		}
+	}
+}
+
+// webhookReceiver is a callback endpoint recording the jobs delivered to it
+func webhookReceiver(t *testing.T, hits *atomic.Int32, jobs chan<- AsyncJob) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if jobs != nil {
+			var job AsyncJob
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &job)
+			jobs <- job
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	var hits atomic.Int32
+	server := webhookReceiver(t, &hits, nil)
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+	job := AsyncJob{ID: "job", Status: JobCompleted}
+
+	tests := []struct {
+		name         string
+		allowedHosts string
+		url          string
+		delivered    bool
+	}{
+		// A hostname can resolve to a loopback address, so the check happens when connecting
+		{"loopback without an allowlist", "", server.URL, false},
+		{"allowlisted host", "127.0.0.1", server.URL, true},
+		{"redirect", "127.0.0.1", redirect.URL, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "WEBHOOK_SECRET", "secret", "WEBHOOK_ATTEMPTS", "1", "WEBHOOK_ALLOWED_HOSTS", tt.allowedHosts)
+			hits.Store(0)
+			if got := deliverWebhook(cfg, tt.url, job); got != tt.delivered {
+				t.Errorf("delivered = %v, want %v", got, tt.delivered)
+			}
+			// Refused deliveries never reach the receiver, not even through the redirect
+			if reached := hits.Load() > 0; reached != tt.delivered {
+				t.Errorf("receiver reached = %v, want %v", reached, tt.delivered)
+			}
+		})
+	}
+}
+
+func TestAsyncJobDeliversReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     []string
+		reply   string
+		content string
+	}{
+		{"unchanged", nil, "Virtue is a habit.", "Virtue is a habit."},
+		// The reply is reviewed like a streamed one
+		{"kid safe redaction", []string{"KID_SAFE_MODE", "true"}, "Well, damn.", "Well, ****."},
+		{"stop pattern", []string{"STOP_PATTERNS", "secret plan"}, "Here is the secret plan.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			jobs := make(chan AsyncJob, 1)
+			server := webhookReceiver(t, &hits, jobs)
+			cfg := testConfig(t, append([]string{"WEBHOOK_SECRET", "secret", "WEBHOOK_ATTEMPTS", "1", "WEBHOOK_ALLOWED_HOSTS", "127.0.0.1"}, tt.env...)...)
+
+			job := &AsyncJob{ID: newRequestID(), Status: JobPending, CreatedAt: time.Now()}
+			asyncJobs.add(job, cfg.MaxAsyncJobs)
+			client := &fakeChatClient{replies: []string{tt.reply}, usage: &openai.Usage{TotalTokens: 10}}
+			runAsyncJob(client, cfg, job.ID, "client", "Aristotle", ModeSocratic, openai.ChatCompletionRequest{Model: cfg.DefaultModel}, nil, nil, server.URL)
+
+			if delivered := <-jobs; delivered.Status != JobCompleted || delivered.Content != tt.content {
+				t.Errorf("delivered %+v, want the completed reply %q", delivered, tt.content)
+			}
+			if stored, _ := asyncJobs.get(job.ID); stored.Content != tt.content || !stored.Delivered {
+				t.Errorf("stored content = %q, delivered = %v", stored.Content, stored.Delivered)
+			}
+		})
+	}
+}
+
+func TestAsyncChatRejectsInternalCallback(t *testing.T) {
+	cfg := testConfig(t, "WEBHOOK_SECRET", "secret")
+	for _, callback := range []string{"http://127.0.0.1:4000/", "http://169.254.169.254/latest/meta-data/"} {
+		body := `{"messages":[{"role":"user","content":"Hello"}],"mode":"socratic","selectedFigure":"Aristotle","callbackUrl":"` + callback + `"}`
+		client := &fakeChatClient{}
+		w := serve(asyncChatHandler(client, cfg), body)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid callback URL") || len(client.requests) != 0 {
+			t.Errorf("callback %s: status = %d, body = %s, want 400", callback, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// bannedRule is one BANNED_TOPICS or STOP_PATTERNS entry, plain rules match as case-insensitive substrings and rules
+// prefixed with "re:" as case-insensitive regular expressions
+type bannedRule struct {
+	text    string
+	pattern *regexp.Regexp
+}
+
+// matches reports whether the rule matches the text
+func (r bannedRule) matches(text string) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(text)
+	}
+	return strings.Contains(strings.ToLower(text), strings.ToLower(r.text))
+}
+
+// bannedTopic returns the rule matched by any of the texts, or "" when none is
+func bannedTopic(rules []bannedRule, texts ...string) string {
+	for _, rule := range rules {
+		for _, text := range texts {
+			if text != "" && rule.matches(text) {
+				return rule.text
+			}
+		}
+	}
+	return ""
+}
+
+// maxPatternMatchBytes is how far back STOP_PATTERNS regular expressions look in streamed output, their
+// matches can be of any length so one spanning more than this may be missed
+const maxPatternMatchBytes = 256
+
+// stopMatcher matches STOP_PATTERNS against output as it streams. Each delta is searched along with just
+// enough of the earlier output for a match to span into it, so a long stream isn't searched over and over
+type stopMatcher struct {
+	rules []bannedRule
+	// window is the most earlier output a match ending in a new delta can start in, tail holds it
+	window int
+	tail   string
+}
+
+func newStopMatcher(rules []bannedRule) *stopMatcher {
+	m := &stopMatcher{rules: rules}
+	for _, rule := range rules {
+		length := len(rule.text) + utf8.UTFMax // Lowercasing can change the byte length of a character
+		if rule.pattern != nil {
+			length = maxPatternMatchBytes
+		}
+		m.window = max(m.window, length)
+	}
+	return m
+}
+
+// push adds the next delta and returns the rule the output now matches, "" when none does
+func (m *stopMatcher) push(delta string) string {
+	if len(m.rules) == 0 {
+		return ""
+	}
+	text := m.tail + delta
+	rule := bannedTopic(m.rules, text)
+
+	cut := max(len(text)-m.window, 0)
+	for cut < len(text) && !utf8.RuneStart(text[cut]) {
+		cut++
+	}
+	m.tail = text[cut:]
+	return rule
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStopMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns string
+		deltas   []string
+		// want is the rule matched after each delta
+		want []string
+	}{
+		{"no patterns", "", []string{"secret plan"}, []string{""}},
+		{"within a delta", "secret plan", []string{"Here is ", "the secret plan."}, []string{"", "secret plan"}},
+		{"spanning deltas", "secret plan", []string{"the sec", "ret p", "lan"}, []string{"", "", "secret plan"}},
+		{"ignores case", "secret plan", []string{"The SECRET ", "Plan"}, []string{"", "secret plan"}},
+		{"regex spanning deltas", `re:launch\s+codes?`, []string{"the launch ", "codes"}, []string{"", `re:launch\s+codes?`}},
+		{"long stream before the match", "secret plan", append(strings.Split(strings.Repeat("word ", 500), " "), "secret", " plan"), nil},
+		{"multibyte text", "café secreto", []string{"Un ", "café", " secr", "eto"}, []string{"", "", "", "café secreto"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newStopMatcher(testConfig(t, "STOP_PATTERNS", tt.patterns).StopPatterns)
+			var got []string
+			for _, delta := range tt.deltas {
+				got = append(got, m.push(delta))
+			}
+			if tt.want == nil {
+				// Only the last delta completes the match
+				tt.want = make([]string, len(tt.deltas))
+				tt.want[len(tt.want)-1] = tt.patterns
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matches = %q, want %q", got, tt.want)
+			}
+			if len(m.tail) > m.window {
+				t.Errorf("kept %d bytes of output, want at most %d", len(m.tail), m.window)
+			}
+		})
+	}
+}
+
+func TestStreamStopPatterns(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas []string
+		events []string
+		// requests counts the upstream calls, the suggestions only follow a complete reply
+		requests int
+	}{
+		{"no match", []string{"Know thyself."}, []string{"meta", "suggestions", "done"}, 2},
+		{"match spanning deltas", []string{"Here is the sec", "ret plan: ", "conquer Persia."}, []string{"meta", "blocked"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "STOP_PATTERNS", "secret plan")
+			client := &fakeChatClient{deltas: tt.deltas, replies: []string{`["What is virtue?","How do I live well?"]`}}
+
+			w := serve(chatHandler(client, cfg), `{"message":"What is the plan?","mode":"socratic","selectedFigure":"Aristotle","includeSuggestions":true}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+			types, text := eventTypes(sseEvents(t, w.Body.String()))
+			if !reflect.DeepEqual(types, tt.events) {
+				t.Errorf("events = %v, want %v", types, tt.events)
+			}
+			if strings.Contains(text, "Persia") {
+				t.Errorf("streamed %q past the match", text)
+			}
+			if len(client.requests) != tt.requests {
+				t.Errorf("%d upstream requests, want %d", len(client.requests), tt.requests)
+			}
+		})
+	}
+}
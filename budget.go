@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// tokenBudget counts the tokens each client has used today, the counts reset at midnight UTC
+type tokenBudget struct {
+	mu   sync.Mutex
+	day  string
+	used map[string]int
+}
+
+var dailyTokens = &tokenBudget{used: make(map[string]int)}
+
+// rollover clears the counts when the day has changed, the caller must hold the lock
+func (b *tokenBudget) rollover() {
+	if today := time.Now().UTC().Format("2006-01-02"); b.day != today {
+		b.day = today
+		b.used = make(map[string]int)
+	}
+}
+
+// spent returns the tokens the client has used today
+func (b *tokenBudget) spent(client string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	return b.used[client]
+}
+
+// add records tokens used by the client
+func (b *tokenBudget) add(client string, tokens int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	b.used[client] += tokens
+}
+
+// dailyBudget rejects requests from clients that have used up DAILY_TOKEN_BUDGET tokens today
+func dailyBudget(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.DailyTokenBudget > 0 && dailyTokens.spent(clientID(c)) >= cfg.DailyTokenBudget {
+			fmt.Println("Daily token budget exceeded for client:", clientID(c))
+			// The budget resets at midnight UTC
+			midnight := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			respondRateLimited(c, rateLimitGateway, "daily_budget_exceeded", time.Until(midnight))
+			return
+		}
+		c.Next()
+	}
+}
+
+// recordTokenUsage charges a completion's usage to the client's daily budget, the request stats and
+// the usage records of the figure and model. A request making several completions, like a panel's turns,
+// is charged for all of them
+func recordTokenUsage(c *gin.Context, cfg *Config, figure string, model string, usage *openai.Usage) {
+	if usage == nil {
+		return
+	}
+	mode, _ := c.Get("mode")
+	m, _ := mode.(Mode)
+	recordUsage(cfg, figure, m, model, usage)
+
+	c.Set("tokens", c.GetInt("tokens")+usage.TotalTokens)
+	if cfg.DailyTokenBudget == 0 {
+		return
+	}
+	dailyTokens.add(clientID(c), usage.TotalTokens)
+}
+
+// identifyClient notes who a request is accounted to: the client's API key when API_KEY_MODELS lists it,
+// so users sharing an address each get their own budget and limits, and their IP otherwise. The key is
+// hashed so it never ends up in the logs or the stores
+func identifyClient(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := c.GetHeader(apiKeyHeader); key != "" && key != "*" {
+			if _, ok := cfg.APIKeyModels[key]; ok {
+				sum := sha256.Sum256([]byte(key))
+				c.Set("client", "key:"+hex.EncodeToString(sum[:8]))
+			}
+		}
+		c.Next()
+	}
+}
+
+// clientID identifies the client a request is accounted to
+func clientID(c *gin.Context) string {
+	if id := c.GetString("client"); id != "" {
+		return id
+	}
+	return c.ClientIP()
+}
+
+// includeUsage reports whether streams must ask for their usage, for STREAM_USAGE, the daily budget or the usage records
+func includeUsage(cfg *Config) bool {
+	return cfg.StreamUsage || cfg.DailyTokenBudget > 0 || cfg.UsageFile != ""
+}
+
+// streamUsage fills in the usage of a relayed stream that ended without OpenAI reporting it, like when the
+// client disconnected, estimated from the prompt and the generated text so the stream is still charged
+func streamUsage(cfg *Config, req openai.ChatCompletionRequest, result streamResult) streamResult {
+	if result.usage != nil || !includeUsage(cfg) {
+		return result
+	}
+	prompt := messagesTokens(req.Messages)
+	result.usage = &openai.Usage{PromptTokens: prompt, CompletionTokens: result.generatedTokens, TotalTokens: prompt + result.generatedTokens}
+	result.estimated = true
+	return result
+}
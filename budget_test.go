@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIDPrefersAPIKey(t *testing.T) {
+	cfg := testConfig(t, "API_KEY_MODELS", `{"team-a":["gpt-3.5-turbo"],"*":["gpt-3.5-turbo"]}`)
+	tests := []struct {
+		name string
+		key  string
+		ip   string
+		want string
+	}{
+		{"no key", "", "192.0.2.1", "192.0.2.1"},
+		{"unknown key", "made-up", "192.0.2.1", "192.0.2.1"},
+		{"wildcard is not a key", "*", "192.0.2.1", "192.0.2.1"},
+		{"listed key", "team-a", "192.0.2.1", "key:"},
+		{"listed key from another address", "team-a", "198.51.100.7", "key:"},
+	}
+	var keyID string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := gin.New()
+			var got string
+			app.GET("/", identifyClient(cfg), func(c *gin.Context) { got = clientID(c) })
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.ip + ":1234"
+			if tt.key != "" {
+				r.Header.Set(apiKeyHeader, tt.key)
+			}
+			app.ServeHTTP(httptest.NewRecorder(), r)
+
+			if !strings.HasPrefix(got, tt.want) {
+				t.Fatalf("clientID = %q, want prefix %q", got, tt.want)
+			}
+			if tt.want == "key:" {
+				if strings.Contains(got, tt.key) {
+					t.Errorf("clientID %q contains the raw key", got)
+				}
+				// The same key is the same client wherever it connects from
+				if keyID != "" && got != keyID {
+					t.Errorf("clientID = %q, want %q", got, keyID)
+				}
+				keyID = got
+			}
+		})
+	}
+}
+
+func TestTrustedProxiesSeparateClients(t *testing.T) {
+	for _, tt := range []struct {
+		proxies string
+		want    []string
+	}{
+		{"", []string{"10.1.2.3", "10.1.2.3"}},
+		{"10.0.0.0/8", []string{"203.0.113.5", "203.0.113.9"}},
+	} {
+		cfg := testConfig(t, "TRUSTED_PROXIES", tt.proxies)
+		app := gin.New()
+		if err := app.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		app.GET("/", func(c *gin.Context) { got = append(got, clientID(c)) })
+		for _, forwarded := range []string{"203.0.113.5", "203.0.113.9"} {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "10.1.2.3:1234"
+			r.Header.Set("X-Forwarded-For", forwarded)
+			app.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("TRUSTED_PROXIES=%q: clients = %v, want %v", tt.proxies, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidTrustedProxies(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,router")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), `"router"`) {
+		t.Errorf("loadConfig() error = %v, want TRUSTED_PROXIES problem", err)
+	}
+}
+
+func TestDailyTokenBudget(t *testing.T) {
+	tests := []struct {
+		name       string
+		ip         string
+		disconnect bool
+	}{
+		{"completed without usage chunk", "192.0.2.10", false},
+		{"client disconnected", "192.0.2.11", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "DAILY_TOKEN_BUDGET", "20")
+			client := &fakeChatClient{deltas: []string{"Virtue is ", "a habit, ", "not a feeling."}}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.disconnect {
+				client.hangUp = cancel
+			}
+			app := gin.New()
+			app.POST("/", requestID(), dailyBudget(cfg), chatHandler(client, cfg))
+			post := func(ctx context.Context) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(streamingEndpoints[0].body)).WithContext(ctx)
+				r.RemoteAddr = tt.ip + ":1234"
+				w := httptest.NewRecorder()
+				app.ServeHTTP(w, r)
+				return w
+			}
+			post(ctx)
+
+			// Without a usage chunk the stream is charged its estimate, which uses up the budget
+			spent := dailyTokens.spent(tt.ip)
+			prompt := messagesTokens(client.lastRequest(t).Messages)
+			if spent <= prompt {
+				t.Errorf("charged %d tokens, want the %d prompt tokens plus the streamed text", spent, prompt)
+			}
+			if w := post(context.Background()); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "daily_budget_exceeded") {
+				t.Errorf("over budget: got %d %s, want 429 daily_budget_exceeded", w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// cachedResponse is a completed response kept for replaying identical requests
+type cachedResponse struct {
+	content      string
+	finishReason openai.FinishReason
+	stored       time.Time
+}
+
+// responseStore caches completed responses in memory by request signature, they are lost on restart
+type responseStore struct {
+	mu        sync.Mutex
+	responses map[string]cachedResponse
+}
+
+var responseCache = &responseStore{responses: make(map[string]cachedResponse)}
+
+// get returns the cached response for a key when it is younger than ttl
+func (s *responseStore) get(key string, ttl time.Duration) (cachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cached, ok := s.responses[key]
+	if !ok || time.Since(cached.stored) > ttl {
+		delete(s.responses, key)
+		return cachedResponse{}, false
+	}
+	return cached, true
+}
+
+// put caches a response, evicting the oldest one once max responses are cached
+func (s *responseStore) put(key string, cached cachedResponse, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.responses[key]; !exists && len(s.responses) >= max {
+		oldestKey := ""
+		for k, r := range s.responses {
+			if oldestKey == "" || r.stored.Before(s.responses[oldestKey].stored) {
+				oldestKey = k
+			}
+		}
+		delete(s.responses, oldestKey)
+	}
+	cached.stored = time.Now()
+	s.responses[key] = cached
+}
+
+// responseCacheKey returns the signature of a completion request, a hash of its model, messages and
+// parameters, or "" when ENABLE_RESPONSE_CACHE is off or the client sent Cache-Control: no-cache
+func responseCacheKey(c *gin.Context, cfg *Config, req openai.ChatCompletionRequest) string {
+	if !cfg.EnableResponseCache {
+		return ""
+	}
+	if cc := strings.ToLower(c.GetHeader("Cache-Control")); strings.Contains(cc, "no-cache") || strings.Contains(cc, "no-store") {
+		return ""
+	}
+
+	// How the response is delivered doesn't change it
+	req.Stream = false
+	req.StreamOptions = nil
+	b, err := jsonEncode(req)
+	if err != nil {
+		fmt.Println("Error encoding request for the response cache:", err)
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// replayCachedResponse streams a cached response as data events a few words at a time, like a live completion
+func replayCachedResponse(c *gin.Context, cached cachedResponse) streamResult {
+	words := strings.SplitAfter(cached.content, " ")
+	for i := 0; i < len(words); i += 4 {
+		if clientGone(c) {
+			return streamResult{end: streamDisconnected}
+		}
+		writeDelta(c, strings.Join(words[i:min(i+4, len(words))], ""))
+		time.Sleep(30 * time.Millisecond)
+	}
+	return streamResult{content: cached.content, end: streamComplete, finishReason: cached.finishReason}
+}
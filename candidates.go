@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Candidate is one of several alternative replies returned when a client asks for candidates
+type Candidate struct {
+	Index   int    `json:"index"`
+	Content string `json:"content"`
+	// Blocked reports that the candidate matched STOP_PATTERNS and was withheld, Flagged that moderation flagged it
+	Blocked bool `json:"blocked,omitempty"`
+	Flagged bool `json:"flagged,omitempty"`
+}
+
+// respondWithCandidates runs a non-streaming completion with n choices and returns them all,
+// streaming several choices at once isn't supported
+func respondWithCandidates(c *gin.Context, cfg *Config, client ChatClient, req openai.ChatCompletionRequest, n int) {
+	req.Stream = false
+	req.N = n
+
+	resp, err := client.CreateChatCompletion(c.Request.Context(), req)
+	if err != nil {
+		fmt.Println("Error creating completion:", err)
+		respondUpstreamError(c, err, "Error generating response")
+		return
+	}
+	recordTokenUsage(c, cfg, c.GetString("figure"), req.Model, &resp.Usage)
+
+	candidates := make([]Candidate, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		content, blocked, flagged := reviewReply(c.Request.Context(), cfg, client, c.GetString("requestID"), choice.Message.Content)
+		candidates = append(candidates, Candidate{Index: choice.Index, Content: content, Blocked: blocked, Flagged: flagged})
+	}
+	c.JSON(http.StatusOK, gin.H{"candidates": candidates, "usage": resp.Usage})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ChatStream is a stream of chat completion deltas
+type ChatStream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// ChatStreamer opens streaming chat completions
+type ChatStreamer interface {
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error)
+}
+
+// ChatClient is the part of the OpenAI API the handlers use, so tests can substitute a fake
+type ChatClient interface {
+	ChatStreamer
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	Moderations(ctx context.Context, req openai.ModerationRequest) (openai.ModerationResponse, error)
+}
+
+// openAIClient adapts *openai.Client to ChatClient
+type openAIClient struct {
+	*openai.Client
+}
+
+// newOpenAIClient creates the OpenAI client with an HTTP client that honors HTTPS_PROXY/NO_PROXY
+// and OPENAI_TLS_TIMEOUT_SECONDS, scoped to OPENAI_ORG_ID and OPENAI_PROJECT_ID when set
+func newOpenAIClient(cfg *Config) openAIClient {
+	config := openai.DefaultConfig(cfg.OpenAIAPIKey)
+	config.OrgID = cfg.OpenAIOrgID
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.TLSHandshakeTimeout = cfg.OpenAITLSTimeout
+
+	// go-openai has no project setting, so the header is added to every request
+	var roundTripper http.RoundTripper = transport
+	if cfg.OpenAIProjectID != "" {
+		roundTripper = projectTransport{projectID: cfg.OpenAIProjectID, next: transport}
+	}
+	config.HTTPClient = &http.Client{Transport: roundTripper}
+
+	fmt.Println("OpenAI API key source:", cfg.OpenAIAPIKeySource)
+	logEffectiveProxy(config.BaseURL)
+	if config.OrgID != "" {
+		fmt.Println("OpenAI organization:", maskID(config.OrgID))
+	}
+	if cfg.OpenAIProjectID != "" {
+		fmt.Println("OpenAI project:", maskID(cfg.OpenAIProjectID))
+	}
+	return openAIClient{openai.NewClientWithConfig(config)}
+}
+
+// projectTransport sets the OpenAI-Project header so usage is attributed to the project
+type projectTransport struct {
+	projectID string
+	next      http.RoundTripper
+}
+
+func (t projectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("OpenAI-Project", t.projectID)
+	return t.next.RoundTrip(req)
+}
+
+// Helper function to mask an ID for logging, keeping only its last four characters
+func maskID(id string) string {
+	if len(id) <= 4 {
+		return "****"
+	}
+	return "****" + id[len(id)-4:]
+}
+
+// logEffectiveProxy prints which proxy, if any, requests to the OpenAI API will go through
+func logEffectiveProxy(baseURL string) {
+	target, err := url.Parse(baseURL)
+	if err != nil {
+		fmt.Println("Invalid OpenAI base URL:", baseURL)
+		return
+	}
+
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: target})
+	switch {
+	case err != nil:
+		fmt.Println("Invalid proxy configuration:", err)
+	case proxy == nil:
+		fmt.Println("OpenAI requests are not proxied")
+	default:
+		// Never log proxy credentials
+		proxy.User = nil
+		fmt.Println("OpenAI requests go through proxy:", proxy.String())
+	}
+}
+
+// CreateChatCompletionStream opens a stream with the real OpenAI client
+func (c openAIClient) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error) {
+	stream, err := c.Client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		// Avoid returning a typed nil pointer wrapped in a non-nil interface
+		return nil, err
+	}
+	return stream, nil
+}
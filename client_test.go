@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// fakeChatClient is a ChatClient answering from canned replies instead of calling OpenAI
+type fakeChatClient struct {
+	mu sync.Mutex
+	// deltas are what CreateChatCompletionStream streams, one chunk each before a chunk finishing the completion
+	deltas []string
+	// streams are the deltas of the streams opened in turn, before deltas applies
+	streams [][]string
+	// replies are the choices CreateChatCompletion returns
+	replies []string
+	// err fails creating completions, and opening streams once streams are used up
+	err error
+	// usage is sent in a final chunk of every stream and returned by CreateChatCompletion
+	usage *openai.Usage
+	// connectDelay is how long opening a stream takes, chunkDelay how long each chunk takes to arrive
+	connectDelay time.Duration
+	chunkDelay   time.Duration
+	// hangUp is called once a stream has sent its chunks, to disconnect the client mid-stream
+	hangUp func()
+	// requests records every completion request received
+	requests []openai.ChatCompletionRequest
+}
+
+func (f *fakeChatClient) record(req openai.ChatCompletionRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+}
+
+func (f *fakeChatClient) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error) {
+	f.record(req)
+	if err := wait(ctx, f.connectDelay); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	deltas := f.deltas
+	queued := len(f.streams) > 0
+	if queued {
+		deltas, f.streams = f.streams[0], f.streams[1:]
+	}
+	f.mu.Unlock()
+	if f.err != nil && !queued {
+		return nil, f.err
+	}
+	var chunks []openai.ChatCompletionStreamResponse
+	for _, delta := range deltas {
+		chunks = append(chunks, openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: delta}}}})
+	}
+	chunks = append(chunks, openai.ChatCompletionStreamResponse{Choices: []openai.ChatCompletionStreamChoice{{FinishReason: openai.FinishReasonStop}}})
+	if f.usage != nil {
+		chunks = append(chunks, openai.ChatCompletionStreamResponse{Usage: f.usage})
+	}
+	return &fakeStream{ctx: ctx, chunks: chunks, delay: f.chunkDelay, hangUp: f.hangUp}, nil
+}
+
+func (f *fakeChatClient) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	f.record(req)
+	if f.err != nil {
+		return openai.ChatCompletionResponse{}, f.err
+	}
+	var resp openai.ChatCompletionResponse
+	if f.usage != nil {
+		resp.Usage = *f.usage
+	}
+	for i, reply := range f.replies {
+		resp.Choices = append(resp.Choices, openai.ChatCompletionChoice{Index: i, Message: openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reply}})
+	}
+	return resp, nil
+}
+
+func (f *fakeChatClient) Moderations(ctx context.Context, req openai.ModerationRequest) (openai.ModerationResponse, error) {
+	return openai.ModerationResponse{Results: []openai.Result{{}}}, nil
+}
+
+// lastRequest returns the latest completion request the fake received
+func (f *fakeChatClient) lastRequest(t *testing.T) openai.ChatCompletionRequest {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		t.Fatal("no completion request was made")
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// fakeStream replays chunks, then ends with io.EOF, or with the client gone when it hangs up
+type fakeStream struct {
+	ctx    context.Context
+	chunks []openai.ChatCompletionStreamResponse
+	delay  time.Duration
+	hangUp func()
+}
+
+// wait sleeps for d unless ctx ends first
+func wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *fakeStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	if err := wait(s.ctx, s.delay); err != nil {
+		return openai.ChatCompletionStreamResponse{}, err
+	}
+	if len(s.chunks) == 0 {
+		if s.hangUp != nil {
+			s.hangUp()
+			return openai.ChatCompletionStreamResponse{}, s.ctx.Err()
+		}
+		return openai.ChatCompletionStreamResponse{}, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *fakeStream) Close() error {
+	return nil
+}
+
+// testConfig loads the configuration with an API key and the given environment variable pairs set
+func testConfig(t *testing.T, env ...string) *Config {
+	t.Helper()
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	for i := 0; i+1 < len(env); i += 2 {
+		t.Setenv(env[i], env[i+1])
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// serve sends a JSON POST to a handler mounted behind the request ID middleware
+func serve(handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	return serveRoute(http.MethodPost, "/", "/", "192.0.2.1", handler, body)
+}
+
+// serveRoute sends a request for path from the client IP to a handler mounted on route
+func serveRoute(method string, route string, path string, ip string, handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.Handle(method, route, requestID(), handler)
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"compress/gzip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gzipSSEWriter gzips the event stream while still flushing every event through to the client
+type gzipSSEWriter struct {
+	gin.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipSSEWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+func (w *gzipSSEWriter) WriteString(s string) (int, error) {
+	return w.gz.Write([]byte(s))
+}
+
+// Flush pushes the compressed bytes written so far out to the client
+func (w *gzipSSEWriter) Flush() {
+	w.gz.Flush()
+	w.ResponseWriter.Flush()
+}
+
+// compressStream swaps the context writer for a gzip one when enabled (GZIP_SSE) and the client
+// accepts gzip, the returned function must be called once the stream is finished
+func compressStream(c *gin.Context, enabled bool) func() {
+	if !enabled || !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+		return func() {}
+	}
+
+	c.Writer.Header().Set("Content-Encoding", "gzip")
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+
+	w := &gzipSSEWriter{ResponseWriter: c.Writer, gz: gzip.NewWriter(c.Writer)}
+	c.Writer = w
+	return func() {
+		w.gz.Close()
+	}
+}
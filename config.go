@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings read from the environment once at startup
+type Config struct {
+	// Server
+	Port string
+	// Env is the deployment environment, experimental figures are served in "staging" and "development"
+	Env        string
+	AdminToken string
+	// Location is SERVER_TZ, the time zone of the date given to figures
+	Location *time.Location
+	// TrustedProxies are the proxies whose X-Forwarded-For is believed for the client IP, behind the Heroku
+	// router that's every address since its IPs aren't fixed. Empty trusts none and uses the connecting address
+	TrustedProxies []string
+	// ResponseHeaders are static headers added to every response, e.g. for security tooling
+	ResponseHeaders map[string]string
+	// AllowedOrigins are the origins CORS lets call the API
+	AllowedOrigins []string
+	// MaintenanceMode starts the server with new chats paused, answered with a 503 and MaintenanceMessage
+	MaintenanceMode    bool
+	MaintenanceMessage string
+
+	// OpenAI client
+	OpenAIAPIKey string
+	// OpenAIAPIKeySource names where the key was read from, for logging
+	OpenAIAPIKeySource     string
+	OpenAIOrgID            string
+	OpenAIProjectID        string
+	OpenAITLSTimeout       time.Duration
+	StartupSelfTest        bool
+	StartupSelfTestStrict  bool
+	StartupSelfTestTimeout time.Duration
+	PingTimeout            time.Duration
+	WarmupOnStart          bool
+	WarmupTimeout          time.Duration
+
+	// Models
+	AllowedModels    map[string]bool
+	DefaultModel     string
+	SuggestionsModel string
+	// ModelTiers ranks the models from weakest to strongest, ModeMinModels is the weakest model each mode
+	// may use and MinModelPolicy says whether weaker requested models are upgraded or rejected
+	ModelTiers     []string
+	ModeMinModels  map[Mode]string
+	MinModelPolicy string
+	// APIKeyModels maps client API keys to the models they may use, "*" applies to requests without a listed key
+	APIKeyModels map[string][]string
+
+	// Figures
+	PromptsFile string
+	MinFigures  int
+	// GenericPromptTemplate is the persona prompt of figures outside the catalog, with the same placeholders as mode templates
+	GenericPromptTemplate string
+	// StrictFigures serves catalog figures only, unknown figures are 404s instead of generic personas
+	StrictFigures bool
+
+	// MaxCustomFigures caps the distinct figures outside the catalog a client may use within
+	// CustomFigureWindow, 0 disables the cap
+	MaxCustomFigures   int
+	CustomFigureWindow time.Duration
+
+	// Trending figures, TrendingWindow 0 counts all-time and TrendingFile persists the counts when set
+	TrendingWindow        time.Duration
+	TrendingFile          string
+	TrendingFlushInterval time.Duration
+
+	// Prompts
+	MaxExtraInstructionsChars int
+	MaxSystemUpdateChars      int
+	MaxConversationInstrChars int
+	MaxSystemPromptChars      int
+	PersonaReminderTurns      int
+	GreetingHint              string
+	GreetingMaxTokens         int
+	BannedTopics              []bannedRule
+
+	// Chat
+	// AllowedClientRoles are the message roles clients may send, a subset of user and assistant. Deployments
+	// that forbid assistant turns keep clients from putting words in the figure's mouth
+	AllowedClientRoles        map[string]bool
+	MaxCandidates             int
+	CollapseDuplicateMessages bool
+	// TemperatureSchedules enables the experimental per-mode temperature schedules
+	TemperatureSchedules bool
+	// ContextWindowTokens overrides the models' context sizes, 0 uses the built-in sizes
+	ContextWindowTokens int
+	// CompletionReserveTokens is the room kept for the reply when a request sets no max_tokens
+	CompletionReserveTokens int
+
+	// Panel discussions
+	MaxPanelFigures    int
+	MaxPanelRounds     int
+	PanelTurnMaxTokens int
+
+	// Streaming
+	StreamUsage           bool
+	RetryOnEmpty          bool
+	SSEHeartbeat          time.Duration
+	StreamMaxDecodeErrors int
+	// MaxStreamDuration is the wall-clock ceiling of a single streamed response, 0 disables it
+	MaxStreamDuration   time.Duration
+	GzipSSE             bool
+	MarkdownSafeFlush   bool
+	NormalizeWhitespace bool
+	// InterruptedMessage is sent in the interrupted event when a stream fails after content was sent
+	InterruptedMessage string
+
+	// Response cache, identical requests are replayed from memory for ResponseCacheTTL
+	EnableResponseCache     bool
+	ResponseCacheTTL        time.Duration
+	ResponseCacheMaxEntries int
+
+	// Moderation, StopPatterns end a stream as soon as its output matches one
+	StopPatterns           []bannedRule
+	EnableOutputModeration bool
+	OutputFlaggedEvent     bool
+	// KidSafeMode adds an age-appropriateness instruction to every prompt and redacts KidSafeWords from replies
+	KidSafeMode  bool
+	KidSafeWords []string
+
+	// MaxStreamsPerIP caps the streams a client may have open at once, 0 disables the cap
+	MaxStreamsPerIP int
+
+	// DailyTokenBudget is the number of tokens each client may use per day, 0 disables the budget
+	DailyTokenBudget int
+
+	// Usage records, the tokens used per day, figure, mode and model are kept in UsageFile when set.
+	// ModelPrices are the USD prices per million tokens the usage report estimates costs with
+	UsageFile          string
+	UsageFlushInterval time.Duration
+	ModelPrices        map[string]modelPrice
+
+	// In-memory stores
+	MaxConversations int
+	MaxAsyncJobs     int
+
+	// Async chat webhooks
+	WebhookSecret       string
+	WebhookAllowedHosts []string
+	WebhookAttempts     int
+	WebhookTimeout      time.Duration
+	AsyncJobTimeout     time.Duration
+
+	// Logging
+	Debug              bool
+	LogRedactContent   bool
+	LogMaxMessageChars int
+	LogMaxMessages     int
+}
+
+// loadConfig reads the configuration from the environment, applying defaults. Every missing or invalid
+// setting is reported in the returned error at once, so a misconfigured deployment fails with the full list
+func loadConfig() (*Config, error) {
+	env := &envReader{}
+
+	cfg := &Config{
+		Port:           env.str("PORT", "4000"),
+		Env:            env.str("ENV", ""),
+		AdminToken:     env.str("ADMIN_TOKEN", ""),
+		Location:       env.location("SERVER_TZ"),
+		TrustedProxies: env.list("TRUSTED_PROXIES", ""),
+
+		ResponseHeaders: env.headers("RESPONSE_HEADERS"),
+		AllowedOrigins:  env.list("ALLOWED_ORIGINS", "http://localhost:3000,https://emersoncoronel.com"),
+
+		MaintenanceMode:    env.bool("MAINTENANCE_MODE", false),
+		MaintenanceMessage: env.str("MAINTENANCE_MESSAGE", "We're temporarily unavailable for maintenance, please try again shortly."),
+
+		OpenAIOrgID:            env.str("OPENAI_ORG_ID", ""),
+		OpenAIProjectID:        env.str("OPENAI_PROJECT_ID", ""),
+		OpenAITLSTimeout:       env.seconds("OPENAI_TLS_TIMEOUT_SECONDS", 10),
+		StartupSelfTest:        env.bool("STARTUP_SELFTEST", false),
+		StartupSelfTestStrict:  env.bool("STARTUP_SELFTEST_STRICT", false),
+		StartupSelfTestTimeout: env.seconds("STARTUP_SELFTEST_TIMEOUT_SECONDS", 5),
+		PingTimeout:            env.seconds("PING_TIMEOUT_SECONDS", 5),
+		WarmupOnStart:          env.bool("WARMUP_ON_START", false),
+		WarmupTimeout:          env.seconds("WARMUP_TIMEOUT_SECONDS", 10),
+
+		AllowedModels:    env.set("ALLOWED_MODELS", "gpt-3.5-turbo,gpt-4o-mini,gpt-4o"),
+		DefaultModel:     env.str("DEFAULT_MODEL", "gpt-3.5-turbo"),
+		SuggestionsModel: env.str("SUGGESTIONS_MODEL", "gpt-3.5-turbo"),
+		ModelTiers:       env.list("MODEL_TIERS", "gpt-3.5-turbo,gpt-4o-mini,gpt-4o"),
+		ModeMinModels:    env.modeModels("MODE_MIN_MODELS"),
+		MinModelPolicy:   env.str("MIN_MODEL_POLICY", "upgrade"),
+		APIKeyModels:     env.keyModels("API_KEY_MODELS"),
+
+		PromptsFile:   env.str("PROMPTS_FILE", ""),
+		MinFigures:    env.int("MIN_FIGURES", len(builtinFigures)),
+		StrictFigures: env.bool("STRICT_FIGURES", false),
+
+		GenericPromptTemplate: env.str("GENERIC_PROMPT_TEMPLATE", defaultGenericTemplate),
+
+		MaxCustomFigures:   env.int("MAX_CUSTOM_FIGURES", 0),
+		CustomFigureWindow: env.seconds("CUSTOM_FIGURE_WINDOW_SECONDS", 3600),
+
+		TrendingWindow:        time.Duration(env.int("TRENDING_WINDOW_HOURS", 0)) * time.Hour,
+		TrendingFile:          env.str("TRENDING_FILE", ""),
+		TrendingFlushInterval: env.seconds("TRENDING_FLUSH_SECONDS", 60),
+
+		UsageFile:          env.str("USAGE_FILE", ""),
+		UsageFlushInterval: env.seconds("USAGE_FLUSH_SECONDS", 60),
+		ModelPrices:        env.prices("MODEL_PRICES"),
+
+		MaxExtraInstructionsChars: env.int("MAX_EXTRA_INSTRUCTIONS_CHARS", 500),
+		MaxSystemUpdateChars:      env.int("MAX_SYSTEM_UPDATE_CHARS", 500),
+		MaxConversationInstrChars: env.int("MAX_CONVERSATION_INSTRUCTION_CHARS", 300),
+		MaxSystemPromptChars:      env.int("MAX_SYSTEM_PROMPT_CHARS", 0),
+		PersonaReminderTurns:      env.int("PERSONA_REMINDER_TURNS", 0),
+		GreetingHint:              env.str("GREETING_HINT", "Begin the dialogue by introducing yourself in 2-3 sentences."),
+		GreetingMaxTokens:         env.int("GREETING_MAX_TOKENS", 0),
+		BannedTopics:              env.rules("BANNED_TOPICS"),
+
+		AllowedClientRoles:        env.set("ALLOWED_CLIENT_ROLES", "user,assistant"),
+		MaxCandidates:             env.int("MAX_CANDIDATES", 3),
+		CollapseDuplicateMessages: env.bool("COLLAPSE_DUPLICATE_MESSAGES", true),
+		TemperatureSchedules:      env.bool("TEMPERATURE_SCHEDULES", false),
+		ContextWindowTokens:       env.int("CONTEXT_WINDOW_TOKENS", 0),
+		CompletionReserveTokens:   env.int("COMPLETION_RESERVE_TOKENS", 1024),
+
+		MaxPanelFigures:    env.int("MAX_PANEL_FIGURES", 4),
+		MaxPanelRounds:     env.int("MAX_PANEL_ROUNDS", 3),
+		PanelTurnMaxTokens: env.int("PANEL_TURN_MAX_TOKENS", 300),
+
+		StreamUsage:           env.bool("STREAM_USAGE", false),
+		RetryOnEmpty:          env.bool("RETRY_ON_EMPTY", false),
+		SSEHeartbeat:          env.seconds("SSE_HEARTBEAT_SECONDS", 15),
+		StreamMaxDecodeErrors: env.int("STREAM_MAX_DECODE_ERRORS", 3),
+		MaxStreamDuration:     env.seconds("MAX_STREAM_DURATION_SECONDS", 0),
+		GzipSSE:               env.bool("GZIP_SSE", false),
+		MarkdownSafeFlush:     env.bool("MARKDOWN_SAFE_FLUSH", false),
+		NormalizeWhitespace:   env.bool("NORMALIZE_WHITESPACE", false),
+		InterruptedMessage:    env.str("INTERRUPTED_MESSAGE", "(the response was interrupted)"),
+
+		EnableResponseCache:     env.bool("ENABLE_RESPONSE_CACHE", false),
+		ResponseCacheTTL:        env.seconds("RESPONSE_CACHE_TTL_SECONDS", 3600),
+		ResponseCacheMaxEntries: env.int("RESPONSE_CACHE_MAX_ENTRIES", 500),
+
+		StopPatterns:           env.rules("STOP_PATTERNS"),
+		EnableOutputModeration: env.bool("ENABLE_OUTPUT_MODERATION", false),
+		OutputFlaggedEvent:     env.bool("OUTPUT_FLAGGED_EVENT", false),
+		KidSafeMode:            env.bool("KID_SAFE_MODE", false),
+		KidSafeWords:           env.list("KID_SAFE_WORDS", defaultKidSafeWords),
+
+		MaxStreamsPerIP: env.int("MAX_STREAMS_PER_IP", 0),
+
+		DailyTokenBudget: env.int("DAILY_TOKEN_BUDGET", 0),
+
+		MaxConversations: env.int("MAX_CONVERSATIONS", 10000),
+		MaxAsyncJobs:     env.int("MAX_ASYNC_JOBS", 1000),
+
+		WebhookSecret:       env.str("WEBHOOK_SECRET", ""),
+		WebhookAllowedHosts: env.list("WEBHOOK_ALLOWED_HOSTS", ""),
+		WebhookAttempts:     env.int("WEBHOOK_ATTEMPTS", 3),
+		WebhookTimeout:      env.seconds("WEBHOOK_TIMEOUT_SECONDS", 10),
+		AsyncJobTimeout:     env.seconds("ASYNC_JOB_TIMEOUT_SECONDS", 120),
+
+		Debug:              env.bool("DEBUG", false),
+		LogRedactContent:   env.bool("LOG_REDACT_CONTENT", false),
+		LogMaxMessageChars: env.int("LOG_MAX_MESSAGE_CHARS", 200),
+		LogMaxMessages:     env.int("LOG_MAX_MESSAGES", 5),
+	}
+
+	cfg.OpenAIAPIKey, cfg.OpenAIAPIKeySource = env.secret("OPENAI_API_KEY")
+
+	if _, err := strconv.Atoi(cfg.Port); err != nil {
+		env.problem("PORT must be a number, got %q", cfg.Port)
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			env.problem("TRUSTED_PROXIES must list IPs or CIDRs, got %q", proxy)
+		}
+	}
+	if len(cfg.AllowedModels) == 0 {
+		env.problem("ALLOWED_MODELS must list at least one model")
+	}
+	if !cfg.AllowedModels[cfg.DefaultModel] {
+		env.problem("DEFAULT_MODEL %q is not in ALLOWED_MODELS", cfg.DefaultModel)
+	}
+	for mode, model := range cfg.ModeMinModels {
+		if !cfg.AllowedModels[model] || modelTier(cfg, model) < 0 {
+			env.problem("MODE_MIN_MODELS sets %q for %s, it must be in ALLOWED_MODELS and MODEL_TIERS", model, mode)
+		}
+	}
+	for key, models := range cfg.APIKeyModels {
+		for _, model := range models {
+			if !cfg.AllowedModels[model] {
+				env.problem("API_KEY_MODELS gives %s model %q, which is not in ALLOWED_MODELS", maskID(key), model)
+			}
+		}
+	}
+	for role := range cfg.AllowedClientRoles {
+		if !clientRoles[role] {
+			env.problem("ALLOWED_CLIENT_ROLES may only contain user and assistant, got %q", role)
+		}
+	}
+	if !cfg.AllowedClientRoles["user"] {
+		env.problem("ALLOWED_CLIENT_ROLES must contain user")
+	}
+	if cfg.MinModelPolicy != "upgrade" && cfg.MinModelPolicy != "reject" {
+		env.problem("MIN_MODEL_POLICY must be upgrade or reject, got %q", cfg.MinModelPolicy)
+	}
+	if !strings.Contains(cfg.GenericPromptTemplate, "{figure}") {
+		env.problem("GENERIC_PROMPT_TEMPLATE must contain {figure}")
+	}
+	if cfg.TrendingFile != "" && cfg.TrendingFlushInterval <= 0 {
+		env.problem("TRENDING_FLUSH_SECONDS must be at least 1 when TRENDING_FILE is set")
+	}
+	if cfg.UsageFile != "" && cfg.UsageFlushInterval <= 0 {
+		env.problem("USAGE_FLUSH_SECONDS must be at least 1 when USAGE_FILE is set")
+	}
+	if cfg.WebhookAttempts < 1 {
+		env.problem("WEBHOOK_ATTEMPTS must be at least 1, got %d", cfg.WebhookAttempts)
+	}
+	if cfg.MaxPanelFigures < 2 || cfg.MaxPanelRounds < 1 {
+		env.problem("MAX_PANEL_FIGURES must be at least 2 and MAX_PANEL_ROUNDS at least 1")
+	}
+	if cfg.EnableResponseCache && cfg.ResponseCacheMaxEntries < 1 {
+		env.problem("RESPONSE_CACHE_MAX_ENTRIES must be at least 1 when ENABLE_RESPONSE_CACHE is set")
+	}
+	if cfg.MaxConversations < 1 || cfg.MaxAsyncJobs < 1 {
+		env.problem("MAX_CONVERSATIONS and MAX_ASYNC_JOBS must be at least 1")
+	}
+
+	if len(env.problems) > 0 {
+		return nil, errors.New("invalid configuration:\n  " + strings.Join(env.problems, "\n  "))
+	}
+	return cfg, nil
+}
+
+// envReader reads typed settings from the environment, collecting every problem instead of stopping at the first
+type envReader struct {
+	problems []string
+}
+
+func (r *envReader) problem(format string, args ...any) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+// str reads a string setting
+func (r *envReader) str(key string, def string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return def
+}
+
+// secret reads a required secret from the file named by key_FILE, as mounted by Kubernetes or Vault,
+// or else from key itself. The file takes precedence, and the returned source says which was used
+func (r *envReader) secret(key string) (string, string) {
+	fileKey := key + "_FILE"
+	if path := r.str(fileKey, ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			r.problem("%s could not be read: %v", fileKey, err)
+			return "", ""
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "" {
+			r.problem("%s points to an empty file %q", fileKey, path)
+			return "", ""
+		}
+		if r.str(key, "") != "" {
+			fmt.Printf("Both %s and %s are set, using %s\n", key, fileKey, fileKey)
+		}
+		return value, fmt.Sprintf("%s (%s)", fileKey, path)
+	}
+
+	if value := r.str(key, ""); value != "" {
+		return value, key
+	}
+	r.problem("%s or %s is required", key, fileKey)
+	return "", ""
+}
+
+// int reads a non-negative integer setting
+func (r *envReader) int(key string, def int) int {
+	value := r.str(key, "")
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		r.problem("%s must be a non-negative integer, got %q", key, value)
+		return def
+	}
+	return n
+}
+
+// seconds reads a duration setting given in whole seconds
+func (r *envReader) seconds(key string, def int) time.Duration {
+	return time.Duration(r.int(key, def)) * time.Second
+}
+
+// bool reads a boolean setting
+func (r *envReader) bool(key string, def bool) bool {
+	value := r.str(key, "")
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		r.problem("%s must be true or false, got %q", key, value)
+		return def
+	}
+	return b
+}
+
+// list reads a comma-separated setting, skipping empty entries
+func (r *envReader) list(key string, def string) []string {
+	var items []string
+	for _, item := range strings.Split(r.str(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// set reads a comma-separated setting as a set
+func (r *envReader) set(key string, def string) map[string]bool {
+	items := make(map[string]bool)
+	for _, item := range r.list(key, def) {
+		items[item] = true
+	}
+	return items
+}
+
+// modeModels reads a comma-separated list of mode=model pairs
+func (r *envReader) modeModels(key string) map[Mode]string {
+	models := make(map[Mode]string)
+	for _, item := range r.list(key, "") {
+		mode, model, ok := strings.Cut(item, "=")
+		mode, model = strings.TrimSpace(mode), strings.TrimSpace(model)
+		if !ok || mode == "" || model == "" || Mode(mode).Validate() != nil {
+			r.problem("%s entry %q must be a known mode=model pair", key, item)
+			continue
+		}
+		models[Mode(mode)] = model
+	}
+	return models
+}
+
+// headers reads a JSON object of response header names and values. Headers that describe the body or the
+// connection are refused, the handlers set those
+func (r *envReader) headers(key string) map[string]string {
+	headers := make(map[string]string)
+	value := r.str(key, "")
+	if value == "" {
+		return headers
+	}
+	if err := json.Unmarshal([]byte(value), &headers); err != nil {
+		r.problem("%s must be a JSON object of header names and values: %v", key, err)
+		return headers
+	}
+	for name := range headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Type", "Content-Length", "Content-Encoding", "Connection", "Transfer-Encoding":
+			r.problem("%s may not set %s", key, name)
+			delete(headers, name)
+		}
+	}
+	return headers
+}
+
+// prices reads a JSON object of model prices per million tokens, e.g. {"gpt-4o":{"prompt":2.5,"completion":10}},
+// on top of defaultModelPrices
+func (r *envReader) prices(key string) map[string]modelPrice {
+	prices := make(map[string]modelPrice)
+	for model, price := range defaultModelPrices {
+		prices[model] = price
+	}
+	if value := r.str(key, ""); value != "" {
+		var overrides map[string]modelPrice
+		if err := json.Unmarshal([]byte(value), &overrides); err != nil {
+			r.problem("%s must be a JSON object of models and prices: %v", key, err)
+		}
+		for model, price := range overrides {
+			prices[model] = price
+		}
+	}
+	return prices
+}
+
+// keyModels reads a JSON object mapping API keys to lists of models
+func (r *envReader) keyModels(key string) map[string][]string {
+	models := make(map[string][]string)
+	if value := r.str(key, ""); value != "" {
+		if err := json.Unmarshal([]byte(value), &models); err != nil {
+			r.problem("%s must be a JSON object of API keys and model lists: %v", key, err)
+		}
+	}
+	return models
+}
+
+// location reads a time zone name, UTC when unset
+func (r *envReader) location(key string) *time.Location {
+	name := r.str(key, "")
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		r.problem("%s is not a known time zone: %q", key, name)
+		return time.UTC
+	}
+	return loc
+}
+
+// rules reads a list of banned text rules, compiling the "re:" patterns
+func (r *envReader) rules(key string) []bannedRule {
+	var rules []bannedRule
+	for _, item := range r.list(key, "") {
+		rule := bannedRule{text: item}
+		if pattern, ok := strings.CutPrefix(item, "re:"); ok {
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				r.problem("%s has an invalid pattern %q: %v", key, pattern, err)
+				continue
+			}
+			rule.pattern = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// templatePlaceholders are the placeholders renderTemplate fills in
+var templatePlaceholders = map[string]bool{"figure": true, "topic": true, "ending": true}
+
+// ConfigIssue is one problem found in a prompts config, Figure and Mode are empty when it isn't about one
+type ConfigIssue struct {
+	Figure  string `json:"figure,omitempty"`
+	Mode    Mode   `json:"mode,omitempty"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// lintFigures checks a prompts config the way it would be served: required fields, duplicate figures,
+// unknown modes, styles and profiles, disallowed default models, negative limits and template placeholders
+func lintFigures(cfg *Config, figures []Figure) []ConfigIssue {
+	var issues []ConfigIssue
+	if len(figures) < cfg.MinFigures {
+		issues = append(issues, ConfigIssue{Field: "figures", Message: fmt.Sprintf("expected at least %d figures, got %d", cfg.MinFigures, len(figures))})
+	}
+
+	seen := map[string]bool{}
+	for _, f := range figures {
+		report := func(mode Mode, field string, format string, args ...any) {
+			issues = append(issues, ConfigIssue{Figure: f.Name, Mode: mode, Field: field, Message: fmt.Sprintf(format, args...)})
+		}
+
+		name := strings.ToLower(strings.TrimSpace(f.Name))
+		if name == "" {
+			report("", "name", "name is required")
+		} else if seen[name] {
+			report("", "name", "duplicate figure %q", f.Name)
+		}
+		seen[name] = true
+
+		if f.Visibility != VisibilityPublic && f.Visibility != VisibilityExperimental {
+			report("", "visibility", "visibility must be %q or %q", VisibilityPublic, VisibilityExperimental)
+		}
+		if _, ok := modelProfiles[f.Profile]; f.Profile != "" && !ok {
+			report("", "profile", "unknown profile %q", f.Profile)
+		}
+		if f.DefaultModel != "" && !cfg.AllowedModels[f.DefaultModel] {
+			report("", "defaultModel", "model %q is not allowed", f.DefaultModel)
+		}
+		if _, ok := responseStyles[f.Style]; f.Style != "" && !ok {
+			report("", "style", "unknown style %q", f.Style)
+		}
+		if f.ResponseTokenBudget < 0 {
+			report("", "responseTokenBudget", "must not be negative")
+		}
+		for _, problem := range checkPlaceholders(f.GenericTemplate) {
+			report("", "genericTemplate", "%s", problem)
+		}
+
+		if len(f.Modes) == 0 {
+			report("", "modes", "at least one mode is required")
+		}
+		modeNames := make([]string, 0, len(f.Modes))
+		for mode := range f.Modes {
+			modeNames = append(modeNames, string(mode))
+		}
+		sort.Strings(modeNames)
+		for _, m := range modeNames {
+			mode, config := Mode(m), f.Modes[Mode(m)]
+			if mode == "" || mode.Validate() != nil {
+				report(mode, "modes", "unknown mode %q", m)
+				continue
+			}
+			if strings.TrimSpace(config.Template) == "" {
+				report(mode, "template", "template is required")
+			}
+			for _, problem := range checkPlaceholders(config.Template) {
+				report(mode, "template", "%s", problem)
+			}
+			if config.MaxTokens < 0 {
+				report(mode, "maxTokens", "must not be negative")
+			}
+			if config.MaxVariations < 0 {
+				report(mode, "maxVariations", "must not be negative")
+			}
+		}
+	}
+	return issues
+}
+
+// checkPlaceholders reports braces that don't pair up and placeholders renderTemplate doesn't know,
+// either would reach the model as literal text
+func checkPlaceholders(tmpl string) []string {
+	var problems []string
+	open := -1
+	for i, r := range tmpl {
+		switch r {
+		case '{':
+			if open != -1 {
+				problems = append(problems, fmt.Sprintf("unbalanced \"{\" at offset %d", open))
+			}
+			open = i
+		case '}':
+			if open == -1 {
+				problems = append(problems, fmt.Sprintf("unbalanced \"}\" at offset %d", i))
+				continue
+			}
+			if name := tmpl[open+1 : i]; !templatePlaceholders[name] {
+				problems = append(problems, fmt.Sprintf("unknown placeholder \"{%s}\"", name))
+			}
+			open = -1
+		}
+	}
+	if open != -1 {
+		problems = append(problems, fmt.Sprintf("unbalanced \"{\" at offset %d", open))
+	}
+	return problems
+}
+
+// validateConfigHandler handles /api/admin/validate-config, linting a prompts config in the PROMPTS_FILE
+// format without loading it
+func validateConfigHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		var figures []Figure
+		if err := json.Unmarshal(data, &figures); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"valid":  false,
+				"issues": []ConfigIssue{{Field: "figures", Message: err.Error()}},
+			})
+			return
+		}
+
+		issues := lintFigures(cfg, figures)
+		if issues == nil {
+			issues = []ConfigIssue{}
+		}
+		c.JSON(http.StatusOK, gin.H{"valid": len(issues) == 0, "figures": len(figures), "issues": issues})
+	}
+}
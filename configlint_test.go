@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckPlaceholders(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want []string
+	}{
+		{`You are {figure}, discussing "{topic}". {ending}`, nil},
+		{"No placeholders at all.", nil},
+		{"You are {figure}, born in {year}.", []string{`unknown placeholder "{year}"`}},
+		{"You are {figure. {ending}", []string{`unbalanced "{" at offset 8`}},
+		{"You are figure}.", []string{`unbalanced "}" at offset 14`}},
+		{"Ends with {", []string{`unbalanced "{" at offset 10`}},
+	}
+	for _, tt := range tests {
+		if got := checkPlaceholders(tt.tmpl); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("checkPlaceholders(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   []string
+	}{
+		{"valid", `[{"name":"Hypatia","visibility":"public","modes":{"lesson":{"template":"You are {figure}. {ending}"}}}]`, http.StatusOK,
+			[]string{`"valid":true`, `"issues":[]`}},
+		{"not a figure list", `{"name":"Hypatia"}`, http.StatusBadRequest,
+			[]string{`"valid":false`, `"field":"figures"`}},
+		{"duplicate figures", `[{"name":"Hypatia","modes":{"lesson":{"template":"{ending}"}}},{"name":"hypatia","modes":{"lesson":{"template":"{ending}"}}}]`, http.StatusOK,
+			[]string{`"valid":false`, `"message":"duplicate figure \"hypatia\""`}},
+		{"unknown mode and placeholder", `[{"name":"Hypatia","modes":{"juggling":{"template":"{ending}"},"lesson":{"template":"{year}"}}}]`, http.StatusOK,
+			[]string{`"mode":"juggling","field":"modes"`, `"mode":"lesson","field":"template","message":"unknown placeholder \"{year}\""`}},
+		{"unknown style and negative limits", `[{"name":"Hypatia","style":"limerick","responseTokenBudget":-1,"modes":{"lesson":{"template":"{ending}","maxTokens":-1}}}]`, http.StatusOK,
+			[]string{`"field":"style"`, `"field":"responseTokenBudget"`, `"field":"maxTokens"`}},
+		{"missing modes", `[{"name":"Hypatia"}]`, http.StatusOK,
+			[]string{`"field":"modes","message":"at least one mode is required"`}},
+	}
+	cfg := testConfig(t, "MIN_FIGURES", "1")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(validateConfigHandler(cfg), tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body = %s, want %s", w.Body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLintBuiltinFigures(t *testing.T) {
+	cfg := testConfig(t)
+	if issues := lintFigures(cfg, builtinFigures); len(issues) != 0 {
+		t.Errorf("built-in catalog has issues: %+v", issues)
+	}
+}
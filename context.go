@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// modelContextWindows is the context size in tokens of the models we serve, CONTEXT_WINDOW_TOKENS
+// overrides it and unknown models get the smallest window
+var modelContextWindows = map[string]int{
+	"gpt-3.5-turbo": 16385,
+	"gpt-4":         8192,
+	"gpt-4-turbo":   128000,
+	"gpt-4o":        128000,
+	"gpt-4o-mini":   128000,
+}
+
+const defaultContextWindow = 8192
+
+// Token estimates err on the high side, there's no tokenizer here: about three characters per
+// token plus the per-message framing, and a few tokens priming the reply
+const (
+	charsPerToken         = 3
+	messageOverheadTokens = 4
+	replyPrimingTokens    = 3
+)
+
+// contextWindow returns the context size of a model
+func contextWindow(cfg *Config, model string) int {
+	if cfg.ContextWindowTokens > 0 {
+		return cfg.ContextWindowTokens
+	}
+	for name, window := range modelContextWindows {
+		// Dated snapshots like gpt-4o-2024-08-06 share their model's window
+		if model == name || strings.HasPrefix(model, name+"-2") {
+			return window
+		}
+	}
+	return defaultContextWindow
+}
+
+// estimateTokens estimates the tokens a text takes up
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken
+}
+
+// messagesTokens estimates the prompt tokens of a list of messages
+func messagesTokens(messages []openai.ChatCompletionMessage) int {
+	n := replyPrimingTokens
+	for _, msg := range messages {
+		n += messageOverheadTokens + estimateTokens(msg.Content)
+	}
+	return n
+}
+
+// fitContext makes the whole request fit the model's context window with room left for max_tokens of
+// output (COMPLETION_RESERVE_TOKENS when the request sets none). The oldest history goes first, then the
+// low-priority parts of the system prompt; the persona, the latest user message and any focus update
+// after it are always kept. It returns how many history messages were dropped, and false when even what
+// must be kept doesn't fit
+func fitContext(cfg *Config, req *openai.ChatCompletionRequest, prompt *systemPrompt) (int, bool) {
+	reserve := req.MaxTokens
+	if reserve == 0 {
+		reserve = cfg.CompletionReserveTokens
+	}
+	budget := contextWindow(cfg, req.Model) - reserve
+
+	// The system prompt is first, everything from the latest user message on is kept
+	keepFrom := len(req.Messages) - 1
+	for keepFrom > 1 && req.Messages[keepFrom].Role != openai.ChatMessageRoleUser {
+		keepFrom--
+	}
+	if keepFrom < 1 {
+		keepFrom = 1
+	}
+	system, history, tail := req.Messages[0], req.Messages[1:keepFrom], req.Messages[keepFrom:]
+
+	dropped := 0
+	for len(history) > 0 && messagesTokens(joinMessages(system, history, tail)) > budget {
+		// Persona reminders go along with the turns they follow but aren't counted as history
+		if history[0].Role != openai.ChatMessageRoleSystem {
+			dropped++
+		}
+		history = history[1:]
+	}
+
+	if over := messagesTokens(joinMessages(system, history, tail)) - budget; over > 0 {
+		maxChars := (estimateTokens(system.Content) - over) * charsPerToken
+		if maxChars <= 0 {
+			return dropped, false
+		}
+		system.Content = prompt.render(maxChars)
+		if messagesTokens(joinMessages(system, history, tail)) > budget {
+			return dropped, false
+		}
+	}
+
+	if dropped > 0 {
+		fmt.Printf("Dropped %d history message(s) to fit the %s context window\n", dropped, req.Model)
+	}
+	req.Messages = joinMessages(system, history, tail)
+	return dropped, true
+}
+
+// joinMessages puts the system prompt, history and kept tail back together
+func joinMessages(system openai.ChatCompletionMessage, history, tail []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	messages := make([]openai.ChatCompletionMessage, 0, 1+len(history)+len(tail))
+	messages = append(messages, system)
+	messages = append(messages, history...)
+	return append(messages, tail...)
+}
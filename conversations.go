@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Conversation is a dialogue kept by the server so later turns can continue it
+type Conversation struct {
+	ID     string `json:"id"`
+	Figure string `json:"figure"`
+	Mode   Mode   `json:"mode"`
+	Topic  string `json:"topic"`
+	// Model is locked when the conversation starts, later turns use it unless they explicitly pick another
+	Model string `json:"model"`
+	// Params are the sampling parameters the conversation runs with, later turns reuse them unless
+	// they pick a profile or parameters of their own
+	Params ModelParams `json:"params"`
+	// Instruction is the standing instruction added to the system prompt on every turn
+	Instruction string    `json:"instruction,omitempty"`
+	Messages    []Message `json:"messages"`
+	// ForkedFrom is the conversation this one branched off from
+	ForkedFrom string    `json:"forkedFrom,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	// Client is the client that started the conversation, only it may read or continue it and it appears
+	// in that client's conversation list
+	Client string `json:"-"`
+	// Owner is the client that created the conversation under its own ID, only that client may continue it
+	Owner string `json:"-"`
+}
+
+// ConversationSummary is a conversation as listed by /api/conversations, without its messages
+type ConversationSummary struct {
+	ID        string    `json:"id"`
+	Figure    string    `json:"figure"`
+	Mode      Mode      `json:"mode"`
+	Topic     string    `json:"topic"`
+	Title     string    `json:"title"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// maxTitleChars is the length conversation titles are cut to
+const maxTitleChars = 60
+
+// summary describes the conversation for a list, titled by its first user message or else its topic
+func (conv *Conversation) summary() ConversationSummary {
+	title := conv.Topic
+	for _, msg := range conv.Messages {
+		if msg.Role == openai.ChatMessageRoleUser && strings.TrimSpace(msg.Content) != "" {
+			title = strings.Join(strings.Fields(msg.Content), " ")
+			break
+		}
+	}
+	if runes := []rune(title); len(runes) > maxTitleChars {
+		title = strings.TrimSpace(string(runes[:maxTitleChars-1])) + "…"
+	}
+	return ConversationSummary{ID: conv.ID, Figure: conv.Figure, Mode: conv.Mode, Topic: conv.Topic, Title: title, UpdatedAt: conv.UpdatedAt}
+}
+
+// uuidPattern matches a UUID in its canonical 8-4-4-4-12 form
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// clientConversationID returns the canonical form of a client-supplied conversation ID, false if it isn't a UUID
+func clientConversationID(id string) (string, bool) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	return id, uuidPattern.MatchString(id)
+}
+
+// conversationStore keeps conversations in memory, they are lost on restart
+type conversationStore struct {
+	mu            sync.Mutex
+	conversations map[string]*Conversation
+	// byClient indexes the conversation IDs by the client that started them, for listing
+	byClient map[string]map[string]bool
+}
+
+var conversations = &conversationStore{conversations: make(map[string]*Conversation), byClient: make(map[string]map[string]bool)}
+
+// get returns a copy of a stored conversation
+func (s *conversationStore) get(id string) (Conversation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv, ok := s.conversations[id]
+	if !ok {
+		return Conversation{}, false
+	}
+	copied := *conv
+	copied.Messages = append([]Message(nil), conv.Messages...)
+	return copied, true
+}
+
+// save stores a conversation, evicting the least recently updated one once max conversations are stored
+func (s *conversationStore) save(conv Conversation, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.conversations[conv.ID]; !exists && len(s.conversations) >= max {
+		var oldest *Conversation
+		for _, stored := range s.conversations {
+			if oldest == nil || stored.UpdatedAt.Before(oldest.UpdatedAt) {
+				oldest = stored
+			}
+		}
+		if oldest != nil {
+			delete(s.conversations, oldest.ID)
+			delete(s.byClient[oldest.Client], oldest.ID)
+			if len(s.byClient[oldest.Client]) == 0 {
+				delete(s.byClient, oldest.Client)
+			}
+		}
+	}
+
+	conv.UpdatedAt = time.Now()
+	s.conversations[conv.ID] = &conv
+	if s.byClient[conv.Client] == nil {
+		s.byClient[conv.Client] = make(map[string]bool)
+	}
+	s.byClient[conv.Client][conv.ID] = true
+}
+
+// list returns the summaries of the client's conversations with the figure (any when empty) and a topic
+// containing topic, ignoring case, most recently updated first
+func (s *conversationStore) list(client string, figure string, topic string) []ConversationSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topic = strings.ToLower(strings.TrimSpace(topic))
+	summaries := []ConversationSummary{}
+	for id := range s.byClient[client] {
+		conv := s.conversations[id]
+		if figure != "" && !strings.EqualFold(conv.Figure, figure) {
+			continue
+		}
+		if topic != "" && !strings.Contains(strings.ToLower(conv.Topic), topic) {
+			continue
+		}
+		summaries = append(summaries, conv.summary())
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].UpdatedAt.After(summaries[j].UpdatedAt)
+	})
+	return summaries
+}
+
+// listConversationsHandler handles /api/conversations, the client's conversations filtered by ?figure= and
+// ?topic= (a case-insensitive match within the topic), paginated with ?limit= (20 by default, at most 100) and ?offset=
+func listConversationsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	summaries := conversations.list(clientID(c), strings.TrimSpace(c.Query("figure")), c.Query("topic"))
+	total := len(summaries)
+	page := summaries[min(offset, total):min(offset+limit, total)]
+	c.JSON(http.StatusOK, gin.H{"conversations": page, "total": total, "limit": limit, "offset": offset})
+}
+
+// getConversationHandler handles /api/conversations/:id, returning a stored conversation and its locked model
+// to the client that started it. Other clients get a 404, as if it didn't exist
+func getConversationHandler(c *gin.Context) {
+	conv, ok := conversations.get(c.Param("id"))
+	if !ok || conv.Client != clientID(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	c.JSON(http.StatusOK, conv)
+}
+
+// ForkRequestBody represents the request body for /api/conversations/:id/fork
+type ForkRequestBody struct {
+	// AtIndex is the index of the message the new branch replaces, the messages before it are copied
+	AtIndex *int `json:"atIndex"`
+}
+
+// forkConversationHandler handles /api/conversations/:id/fork, starting a new conversation with the
+// same setup and the messages before atIndex, so the dialogue can continue down a different path.
+// Chat turns on the fork continue from its copied messages, the client only sends the new turn
+func forkConversationHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqBody ForkRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil || reqBody.AtIndex == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		// Forking another client's conversation would expose its transcript
+		conv, ok := conversations.get(c.Param("id"))
+		if !ok || conv.Client != clientID(c) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+			return
+		}
+
+		at := *reqBody.AtIndex
+		if at < 0 || at > len(conv.Messages) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message index"})
+			return
+		}
+
+		fork := conv
+		fork.ID = newRequestID()
+		fork.ForkedFrom = conv.ID
+		// The fork has a server-generated ID, so it has no owner even when the original was created under a client's UUID
+		fork.Owner = ""
+		fork.Client = clientID(c)
+		fork.Messages = conv.Messages[:at]
+		fork.CreatedAt = time.Now()
+		conversations.save(fork, cfg.MaxConversations)
+
+		fmt.Printf("Forked conversation %s at message %d into %s\n", conv.ID, at, fork.ID)
+		c.JSON(http.StatusCreated, gin.H{"conversationId": fork.ID})
+	}
+}
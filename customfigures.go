@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// customFigureTracker remembers which custom figures, the names outside the catalog, each client has
+// used recently, so one client can't spin up an unbounded number of personas
+type customFigureTracker struct {
+	mu sync.Mutex
+	// used maps a client to the custom figures it used and when it last did
+	used map[string]map[string]time.Time
+}
+
+var customFigures = &customFigureTracker{used: make(map[string]map[string]time.Time)}
+
+// use records a client using a custom figure, returning false when it would make more than max distinct
+// custom figures within the window. Figures already in use stay allowed
+func (t *customFigureTracker) use(client string, figure string, max int, window time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	figures := t.used[client]
+	if figures == nil {
+		figures = make(map[string]time.Time)
+		t.used[client] = figures
+	}
+	for name, last := range figures {
+		if now.Sub(last) > window {
+			delete(figures, name)
+		}
+	}
+
+	key := strings.ToLower(figure)
+	if _, ok := figures[key]; !ok && len(figures) >= max {
+		return false
+	}
+	figures[key] = now
+	return true
+}
+
+// allowCustomFigure enforces MAX_CUSTOM_FIGURES per client over CUSTOM_FIGURE_WINDOW_SECONDS, responding
+// with 429 and returning false when the client is over it. Catalog figures are always allowed
+func allowCustomFigure(c *gin.Context, cfg *Config, figure string) bool {
+	if cfg.MaxCustomFigures == 0 {
+		return true
+	}
+	if _, ok := lookupFigure(figure); ok {
+		return true
+	}
+	if customFigures.use(clientID(c), figure, cfg.MaxCustomFigures, cfg.CustomFigureWindow) {
+		return true
+	}
+	fmt.Printf("Custom figure cap of %d reached for client %s, rejected %q\n", cfg.MaxCustomFigures, clientID(c), figure)
+	respondRateLimited(c, rateLimitGateway, "custom_figure_limit", cfg.CustomFigureWindow)
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// debugReplayHandler handles /api/debug/replay, resolving a chat request exactly as /api/chat does and
+// returning the completion request that would be sent upstream, without calling OpenAI
+func debugReplayHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqBody ChatRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		req, _, ok := prepareChat(c, cfg, &reqBody)
+		if !ok {
+			return
+		}
+
+		// The same adjustments respondWithCandidates, respondWithVariations and streamCompletion make before sending
+		if reqBody.Candidates > 1 {
+			req.Stream = false
+			req.N = reqBody.Candidates
+		} else if reqBody.Variations > 1 {
+			req.Stream = false
+			req.N = reqBody.Variations
+		} else if includeUsage(cfg) {
+			req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"request":        req,
+			"historyDropped": c.GetInt("historyDropped"),
+			"names":          c.GetStringMapString("messageNames"),
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// deltaFilter transforms streamed content before it is sent, it may hold text back until it's safe to send
+type deltaFilter interface {
+	// push takes the next delta and returns the text that can be sent now
+	push(delta string) string
+	// flush returns the text still held back, called once the stream has ended
+	flush() string
+}
+
+// deltaChain runs deltas through several filters in order
+type deltaChain []deltaFilter
+
+// newDeltaChain builds the filters enabled in the config, after the split character filter that always
+// runs first so the others see a split character as one
+func newDeltaChain(cfg *Config) deltaChain {
+	chain := deltaChain{&splitCharFilter{}}
+	if cfg.NormalizeWhitespace {
+		chain = append(chain, &whitespaceFilter{})
+	}
+	if cfg.KidSafeMode {
+		chain = append(chain, newProfanityFilter(cfg.KidSafeWords))
+	}
+	if cfg.MarkdownSafeFlush {
+		chain = append(chain, &markdownFilter{state: markdownState{atLineStart: true}})
+	}
+	return chain
+}
+
+func (ch deltaChain) push(delta string) string {
+	for _, f := range ch {
+		delta = f.push(delta)
+	}
+	return delta
+}
+
+func (ch deltaChain) flush() string {
+	text := ""
+	for _, f := range ch {
+		text = f.push(text) + f.flush()
+	}
+	return text
+}
+
+// splitCharFilter merges the halves of a character OpenAI split across deltas. The halves, bytes of it or
+// the two parts of a surrogate pair, can't be decoded on their own, so they reach us as a replacement character
+// each. A trailing replacement character is held back, and when the next delta starts with the other half the
+// two are sent as a single one
+type splitCharFilter struct {
+	held bool
+}
+
+// replacementChar is what a character that couldn't be decoded arrives as
+const replacementChar = string(utf8.RuneError)
+
+func (f *splitCharFilter) push(delta string) string {
+	var out string
+	if f.held {
+		f.held = false
+		out = replacementChar
+		delta = strings.TrimPrefix(delta, replacementChar)
+	}
+	if strings.HasSuffix(delta, replacementChar) {
+		f.held = true
+		delta = strings.TrimSuffix(delta, replacementChar)
+	}
+	return out + delta
+}
+
+// flush sends a replacement character the stream ended on
+func (f *splitCharFilter) flush() string {
+	if !f.held {
+		return ""
+	}
+	f.held = false
+	return replacementChar
+}
+
+// whitespaceFilter drops whitespace before the first content and after the last, and collapses runs
+// of blank lines into one. Whitespace is held back until the next content shows where it belongs
+type whitespaceFilter struct {
+	started bool
+	held    strings.Builder
+}
+
+func (f *whitespaceFilter) push(delta string) string {
+	var out strings.Builder
+	for _, r := range delta {
+		if unicode.IsSpace(r) {
+			if f.started {
+				f.held.WriteRune(r)
+			}
+			continue
+		}
+		f.started = true
+		if f.held.Len() > 0 {
+			out.WriteString(collapseBlankLines(f.held.String()))
+			f.held.Reset()
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// flush drops the held whitespace, it trails the response
+func (f *whitespaceFilter) flush() string {
+	f.held.Reset()
+	return ""
+}
+
+// collapseBlankLines shortens a whitespace run spanning more than one blank line to a single blank
+// line, keeping the indentation that follows the last line break
+func collapseBlankLines(ws string) string {
+	if strings.Count(ws, "\n") <= 2 {
+		return ws
+	}
+	return "\n\n" + ws[strings.LastIndexByte(ws, '\n')+1:]
+}
+
+// markdownState is what markdownFilter knows about the markdown sent so far
+type markdownState struct {
+	atLineStart bool
+	inFence     bool
+	// codeRun is the length of the backtick run that opened an inline code span, 0 outside code
+	codeRun int
+	// emphasis is the marker ("*", "**", "_", "~~" ...) of the open emphasis span, "" outside emphasis
+	emphasis string
+}
+
+// markdownFilter holds back text that would leave the client with a half-open markdown token: a marker
+// run that the next delta may extend, an emphasis or inline code span that isn't closed yet, or a code
+// fence line that isn't complete. Spans left open at the end of a line are given up on and sent as is
+type markdownFilter struct {
+	pending string
+	state   markdownState
+}
+
+func (f *markdownFilter) push(delta string) string {
+	f.pending += delta
+
+	cut, state := safeMarkdownPrefix(f.pending, f.state)
+	out := f.pending[:cut]
+	f.pending = f.pending[cut:]
+	f.state = state
+	return out
+}
+
+func (f *markdownFilter) flush() string {
+	out := f.pending
+	f.pending = ""
+	return out
+}
+
+// safeMarkdownPrefix returns how much of s can be sent without splitting a markdown token, and the
+// state after that prefix
+func safeMarkdownPrefix(s string, st markdownState) (int, markdownState) {
+	safe, safeState := 0, st
+	i := 0
+	for i < len(s) {
+		// Code fences are only sent once their whole line, including the info string, has arrived
+		if st.atLineStart && st.codeRun == 0 && st.emphasis == "" {
+			if s[i] == ' ' || s[i] == '\t' {
+				i++
+				safe, safeState = i, st
+				continue
+			}
+			rest := s[i:]
+			if strings.HasPrefix(rest, "```") || strings.HasPrefix(rest, "~~~") {
+				end := strings.IndexByte(rest, '\n')
+				if end == -1 {
+					break
+				}
+				st.inFence = !st.inFence
+				i += end + 1
+				safe, safeState = i, st
+				continue
+			}
+			if !strings.Contains(rest, "\n") && (strings.HasPrefix("```", rest) || strings.HasPrefix("~~~", rest)) {
+				break // Could still become a fence
+			}
+		}
+
+		if st.inFence {
+			end := strings.IndexByte(s[i:], '\n')
+			if end == -1 {
+				i = len(s)
+				st.atLineStart = false
+			} else {
+				i += end + 1
+				st.atLineStart = true
+			}
+			safe, safeState = i, st
+			continue
+		}
+
+		c := s[i]
+		switch {
+		case c == '\n':
+			// Inline spans don't survive a line break in practice, stop waiting for them to close
+			st.codeRun = 0
+			st.emphasis = ""
+			st.atLineStart = true
+			i++
+		case c == '`' || (st.codeRun == 0 && (c == '*' || c == '_' || c == '~')):
+			n := markerRun(s[i:], c)
+			if i+n == len(s) {
+				return safe, safeState // The next delta may extend the run
+			}
+			marker := s[i : i+n]
+			switch {
+			case c == '`' && st.codeRun == 0:
+				st.codeRun = n
+			case c == '`':
+				if n == st.codeRun {
+					st.codeRun = 0
+				}
+			case st.emphasis == marker:
+				st.emphasis = ""
+			case st.emphasis == "" && opensEmphasis(s, i, n):
+				st.emphasis = marker
+			}
+			st.atLineStart = false
+			i += n
+		default:
+			_, size := utf8.DecodeRuneInString(s[i:])
+			st.atLineStart = false
+			i += size
+		}
+
+		if st.codeRun == 0 && st.emphasis == "" {
+			safe, safeState = i, st
+		}
+	}
+	return safe, safeState
+}
+
+// markerRun counts the repeats of the marker character at the start of s
+func markerRun(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+// opensEmphasis reports whether the marker run of length n at i can open an emphasis span. A run followed
+// by a space ("* item", "5 * 3") doesn't, and neither does an underscore inside a word (snake_case)
+func opensEmphasis(s string, i int, n int) bool {
+	next, _ := utf8.DecodeRuneInString(s[i+n:])
+	if unicode.IsSpace(next) {
+		return false
+	}
+	if s[i] == '_' && i > 0 {
+		prev, _ := utf8.DecodeLastRuneInString(s[:i])
+		if unicode.IsLetter(prev) || unicode.IsDigit(prev) {
+			return false
+		}
+	}
+	return true
+}
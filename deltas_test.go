@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// decodedDeltas decodes the content of stream chunks the way the OpenAI client does, from their JSON
+func decodedDeltas(t *testing.T, contents ...string) []string {
+	t.Helper()
+	var deltas []string
+	for _, content := range contents {
+		var chunk openai.ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(`{"choices":[{"delta":{"content":"`+content+`"}}]}`), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, chunk.Choices[0].Delta.Content)
+	}
+	return deltas
+}
+
+func TestSplitCharFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"runes in separate deltas", []string{"caf", "é ", "你", "好"}, "café 你好"},
+		// The halves of a surrogate pair each decode to a replacement character
+		{"split surrogate pair", []string{`I am \ud83d`, `\ude00 happy`}, "I am � happy"},
+		{"split pair alone", []string{`\ud83d`, `\ude00`}, "�"},
+		// Raw bytes of a rune can't be sent in JSON, invalid ones decode to replacement characters too
+		{"replacement mid delta", []string{`a�b`, "c"}, "a�bc"},
+		{"ends on a replacement", []string{"done", `�`}, "done�"},
+		{"unrelated replacements", []string{`x�`, "y", `�`}, "x�y�"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := newDeltaChain(testConfig(t))
+			var got string
+			for _, delta := range decodedDeltas(t, tt.chunks...) {
+				got += chain.push(delta)
+			}
+			got += chain.flush()
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("%q isn't valid UTF-8", got)
+			}
+		})
+	}
+}
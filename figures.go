@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Figure visibilities
+const (
+	VisibilityPublic       = "public"
+	VisibilityExperimental = "experimental"
+)
+
+// Figure describes a persona in the catalog
+type Figure struct {
+	Name string `json:"name"`
+	// Visibility is "public" or "experimental", experimental figures are only served outside production
+	Visibility string `json:"visibility"`
+	// Profile is the default model parameter profile for the figure
+	Profile string `json:"profile,omitempty"`
+	// DefaultModel overrides the global default model for the figure, it must be in ALLOWED_MODELS
+	DefaultModel string `json:"defaultModel,omitempty"`
+	// IncludeCurrentDate appends today's date to the prompt, for figures that joke about or react to current events
+	IncludeCurrentDate bool `json:"includeCurrentDate,omitempty"`
+	// Disclaimer is woven into the figure's replies where relevant and sent to the client in the meta event,
+	// for figures whose advice could be mistaken for professional guidance
+	Disclaimer string `json:"disclaimer,omitempty"`
+	// Works are the figure's real works it may quote, naming the work when it does
+	Works []string `json:"works,omitempty"`
+	// Modes maps each supported mode to its prompt configuration
+	Modes map[Mode]ModeConfig `json:"modes"`
+	// AnyMode lets the figure be used in modes it has no template for, those use GenericTemplate
+	AnyMode bool `json:"anyMode,omitempty"`
+	// GenericTemplate establishes the persona in modes without a template, it defaults to defaultGenericTemplate
+	GenericTemplate string `json:"genericTemplate,omitempty"`
+	// Style is the figure's default response style, one of responseStyles
+	Style string `json:"style,omitempty"`
+	// ResponseTokenBudget is the figure's max_tokens when its mode sets none, and the ceiling for the
+	// mode's and the client's max_tokens
+	ResponseTokenBudget int `json:"responseTokenBudget,omitempty"`
+}
+
+// ModeConfig is a figure's prompt configuration for one mode
+type ModeConfig struct {
+	// Template is the persona prompt, it may use the {figure}, {topic} and {ending} placeholders
+	Template string `json:"template"`
+	// LengthHint replaces the generic "keep your responses brief" instruction, e.g. "Keep your response under 3 sentences."
+	LengthHint string `json:"lengthHint,omitempty"`
+	// MaxTokens caps the response length for the mode when set
+	MaxTokens int `json:"maxTokens,omitempty"`
+	// TemperatureSchedule cools the temperature as the dialogue goes on, used when TEMPERATURE_SCHEDULES is on
+	TemperatureSchedule *TemperatureSchedule `json:"temperatureSchedule,omitempty"`
+	// RequiresScenario has the figure open by framing the scene when the user hasn't set one up
+	RequiresScenario bool `json:"requiresScenario,omitempty"`
+	// MaxVariations lets chat requests ask for up to this many distinct replies at once with "variations"
+	MaxVariations int `json:"maxVariations,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare template string, the format used before modes had settings
+func (m *ModeConfig) UnmarshalJSON(data []byte) error {
+	var tmpl string
+	if err := json.Unmarshal(data, &tmpl); err == nil {
+		*m = ModeConfig{Template: tmpl}
+		return nil
+	}
+
+	type modeConfig ModeConfig
+	return json.Unmarshal(data, (*modeConfig)(m))
+}
+
+// FigureSummary is the public view of a figure, without its prompt templates
+type FigureSummary struct {
+	Name    string `json:"name"`
+	Modes   []Mode `json:"modes"`
+	AnyMode bool   `json:"anyMode,omitempty"`
+}
+
+// builtinFigures are the curated figures served when no PROMPTS_FILE is configured
+var builtinFigures = []Figure{
+	{
+		Name:       "Aristotle",
+		Visibility: VisibilityPublic,
+		Works:      []string{"Nicomachean Ethics", "Politics", "Metaphysics", "Poetics", "Rhetoric"},
+		Modes: map[Mode]ModeConfig{
+			ModeSocratic: {
+				Template:   `You are Aristotle, the ancient Greek philosopher. Engage the user in a Socratic dialogue about "{topic}". Challenge their assumptions and guide them toward a refined understanding. {ending}`,
+				LengthHint: "Keep your response under 3 sentences, ending with a single question.",
+				MaxTokens:  200,
+				// Explore widely in the first questions, then converge on a refined answer
+				TemperatureSchedule: &TemperatureSchedule{Start: 1.0, End: 0.5, Turns: 10},
+			},
+			ModeTeaching: {
+				Template:   `You are Aristotle, teaching about "{topic}". Provide insightful explanations and examples. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+		},
+	},
+	{
+		Name:       "Albert Einstein",
+		Visibility: VisibilityPublic,
+		Works:      []string{"On the Electrodynamics of Moving Bodies", "Relativity: The Special and the General Theory", "The World As I See It"},
+		Modes: map[Mode]ModeConfig{
+			ModeThoughtExperiment: {
+				Template:   `You are Albert Einstein. Engage the user in a thought experiment about "{topic}". Encourage deep thinking about complex concepts. {ending}`,
+				LengthHint: "Keep your response to a short paragraph, one step of the experiment at a time.",
+				MaxTokens:  300,
+			},
+			ModeLesson: {
+				Template:   `You are Albert Einstein, teaching about "{topic}". Explain the theories and their implications clearly. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+		},
+	},
+	{
+		Name:       "Leonardo da Vinci",
+		Visibility: VisibilityPublic,
+		Modes: map[Mode]ModeConfig{
+			ModeBrainstorm: {
+				Template: `You are Leonardo da Vinci. Collaborate with the user on "{topic}". Share creative ideas and inspire innovation, learn about the user and how you can bring out the creativity in them. {ending}`,
+			},
+			ModeLesson: {
+				Template:   `You are Leonardo da Vinci, teaching about "{topic}". Provide detailed insights and techniques. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+		},
+	},
+	{
+		Name:       "Napoleon Bonaparte",
+		Visibility: VisibilityPublic,
+		Modes: map[Mode]ModeConfig{
+			ModeSimulation: {
+				Template:         `You are Napoleon Bonaparte. Engage the user in a military simulation focused on "{topic}". Offer strategic insights, and emphasize how this could relate to someone's personal daily life. {ending}`,
+				RequiresScenario: true,
+			},
+			ModeLesson: {
+				Template:   `You are Napoleon Bonaparte, teaching about "{topic}". Share leadership principles and experiences. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+		},
+	},
+	{
+		Name:       "Cleopatra",
+		Visibility: VisibilityPublic,
+		Modes: map[Mode]ModeConfig{
+			ModeRolePlay: {
+				Template:         `You are Cleopatra. Engage the user in a role-playing scenario about "{topic}". Navigate diplomatic challenges together. {ending}`,
+				RequiresScenario: true,
+			},
+			ModeLesson: {
+				Template:   `You are Cleopatra, teaching about "{topic}". Share historical insights and cultural knowledge. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+		},
+	},
+	{
+		Name:       "Confucius",
+		Visibility: VisibilityPublic,
+		Works:      []string{"The Analects"},
+		Modes: map[Mode]ModeConfig{
+			ModeDiscussion: {
+				Template:   `You are Confucius. Engage the user in a philosophical discussion about "{topic}". Offer wisdom and provoke thought. {ending}`,
+				LengthHint: "Keep your response to a short paragraph.",
+				MaxTokens:  300,
+			},
+			ModeLesson: {
+				Template:   `You are Confucius, teaching about "{topic}". Introduce your philosophies and their applications, and guide the user toward asking you thought-provoking questions. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+		},
+	},
+	{
+		Name:       "Charles Darwin",
+		Visibility: VisibilityPublic,
+		Works:      []string{"On the Origin of Species", "The Descent of Man", "The Voyage of the Beagle"},
+		Modes: map[Mode]ModeConfig{
+			ModeTeaching: {
+				Template:   `You are Charles Darwin, teaching about "{topic}". Explain the principles of evolution and natural selection, relating them to examples from your observations. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+			ModeDiscussion: {
+				Template:   `You are Charles Darwin. Engage the user in a discussion about "{topic}". Encourage exploration of the natural world and consideration of the processes that drive evolution. {ending}`,
+				LengthHint: "Keep your response to a short paragraph.",
+				MaxTokens:  300,
+			},
+		},
+	},
+	{
+		Name:       "The Rebbe",
+		Visibility: VisibilityPublic,
+		Disclaimer: "This is an educational roleplay, not religious, medical, legal or psychological advice. For personal guidance, consult a rabbi or a qualified professional.",
+		Modes: map[Mode]ModeConfig{
+			ModeGuidance: {
+				Template:   `You are Rabbi Menachem Mendel Schneerson, known as The Rebbe. Provide spiritual guidance on "{topic}". Offer insights based on Jewish teachings and Chassidic philosophy. {ending}`,
+				LengthHint: "Keep your response to a short paragraph.",
+				MaxTokens:  300,
+			},
+			ModeTeaching: {
+				Template:   `You are The Rebbe, teaching about "{topic}". Share wisdom from Jewish mysticism and inspire the user to find meaning and purpose. {ending}`,
+				LengthHint: "Keep your response to one or two short paragraphs.",
+				MaxTokens:  400,
+			},
+		},
+	},
+	{
+		Name:         "David Bowie",
+		Visibility:   VisibilityPublic,
+		Profile:      "creative",
+		DefaultModel: "gpt-4o",
+		Style:        "verse",
+		Modes: map[Mode]ModeConfig{
+			ModeCreativeDiscussion: {
+				Template: `You are David Bowie. Engage the user in a creative discussion about "{topic}". Explore themes of reinvention, creativity, and challenging norms. {ending}`,
+			},
+			ModePhilosophy: {
+				Template: `You are David Bowie, sharing your philosophical insights on "{topic}". Reflect on art, identity, and the nature of change. {ending}`,
+			},
+		},
+	},
+	{
+		Name:               "El Arroyo Sign",
+		Visibility:         VisibilityPublic,
+		Profile:            "creative",
+		DefaultModel:       "gpt-4o-mini",
+		IncludeCurrentDate: true,
+		// One-liners for the sign, the budget keeps them from turning into paragraphs
+		ResponseTokenBudget: 60,
+		Modes: map[Mode]ModeConfig{
+			ModeHumor: {
+				Template:      `You are the El Arroyo Sign, famous for witty one-liners and humorous sayings displayed daily outside the El Arroyo restaurant in Austin, Texas. Craft a funny and clever message about "{topic}". Use puns, sarcasm, or playful humor. Keep it short and punchy, as if it would fit on the sign.`,
+				MaxVariations: 5,
+			},
+		},
+	},
+}
+
+// figureCatalog is the loaded set of figures with dedicated personas
+var figureCatalog = builtinFigures
+
+// catalogLoadError records why PROMPTS_FILE could not be loaded, reported by /ready
+var catalogLoadError error
+
+// loadFigureCatalog replaces the built-in figures with the ones in PROMPTS_FILE, when set,
+// and validates the figures' default models against the allowlist
+func loadFigureCatalog(cfg *Config) {
+	path := cfg.PromptsFile
+	if path == "" {
+		logFigureModelProblems(cfg)
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var figures []Figure
+		if err = json.Unmarshal(data, &figures); err == nil {
+			figureCatalog = figures
+			fmt.Printf("Loaded %d figures from %s\n", len(figures), path)
+			logFigureModelProblems(cfg)
+			return
+		}
+	}
+
+	fmt.Println("ERROR loading prompts file, no curated figures are available:", err)
+	figureCatalog = nil
+	catalogLoadError = err
+}
+
+// logFigureModelProblems reports figures with disallowed default models at load time
+func logFigureModelProblems(cfg *Config) {
+	for _, problem := range checkFigureModels(cfg) {
+		fmt.Println("ERROR in figure catalog:", problem)
+	}
+}
+
+// checkCatalog verifies the loaded catalog has at least MIN_FIGURES figures, each with a valid mode template
+// and an allowed default model
+func checkCatalog(cfg *Config) []string {
+	var problems []string
+	if catalogLoadError != nil {
+		problems = append(problems, fmt.Sprintf("prompts file failed to load: %v", catalogLoadError))
+	}
+
+	if len(figureCatalog) < cfg.MinFigures {
+		problems = append(problems, fmt.Sprintf("expected at least %d figures, loaded %d", cfg.MinFigures, len(figureCatalog)))
+	}
+
+	problems = append(problems, checkFigureModels(cfg)...)
+
+	for _, f := range figureCatalog {
+		valid := 0
+		for mode, config := range f.Modes {
+			if mode != "" && mode.Validate() == nil && strings.TrimSpace(config.Template) != "" {
+				valid++
+			}
+		}
+		if valid == 0 {
+			problems = append(problems, fmt.Sprintf("figure %q has no valid mode template", f.Name))
+		}
+		if _, ok := responseStyles[f.Style]; f.Style != "" && !ok {
+			problems = append(problems, fmt.Sprintf("figure %q has unknown style %q", f.Name, f.Style))
+		}
+		if f.ResponseTokenBudget < 0 {
+			problems = append(problems, fmt.Sprintf("figure %q has a negative response token budget", f.Name))
+		}
+	}
+	return problems
+}
+
+// lookupFigure finds a figure in the catalog by name, ignoring case and surrounding spaces
+func lookupFigure(name string) (Figure, bool) {
+	name = strings.TrimSpace(name)
+	for _, f := range figureCatalog {
+		if strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+	return Figure{}, false
+}
+
+// canonicalFigure returns the catalog's spelling of a figure name, matched case-insensitively,
+// so "aristotle" and "ARISTOTLE" both get Aristotle's persona. Unknown names are only trimmed
+func canonicalFigure(name string) string {
+	if f, ok := lookupFigure(name); ok {
+		return f.Name
+	}
+	return strings.TrimSpace(name)
+}
+
+// visible reports whether the figure may be served in the env (ENV),
+// experimental figures are hidden unless it is "staging" or "development"
+func (f Figure) visible(env string) bool {
+	if f.Visibility != VisibilityExperimental {
+		return true
+	}
+	return env == "staging" || env == "development"
+}
+
+// lookupModeConfig finds a figure's configuration for a mode
+func lookupModeConfig(figure string, mode Mode) (ModeConfig, bool) {
+	f, ok := lookupFigure(figure)
+	if !ok {
+		return ModeConfig{}, false
+	}
+	config, ok := f.Modes[mode]
+	return config, ok
+}
+
+// modeSupported reports whether a catalog figure can be used in the requested mode. Figures outside
+// the catalog, figures that opt into any mode and requests without a mode are always allowed
+func modeSupported(figure string, mode Mode) bool {
+	f, ok := lookupFigure(figure)
+	if !ok || f.AnyMode || mode == "" {
+		return true
+	}
+	_, ok = f.Modes[mode]
+	return ok
+}
+
+// figureDisclaimer returns the disclaimer of a catalog figure, if it has one
+func figureDisclaimer(figure string) string {
+	f, _ := lookupFigure(figure)
+	return f.Disclaimer
+}
+
+// figureAvailable reports whether a requested figure may be served: catalog figures visible in this
+// environment, and figures outside the catalog unless STRICT_FIGURES is set or the name looks like a
+// misspelled catalog figure, which would otherwise get a generic persona instead of the dedicated one
+func figureAvailable(cfg *Config, name string) bool {
+	f, ok := lookupFigure(name)
+	if !ok {
+		return !cfg.StrictFigures && len(figureSuggestions(cfg, name)) == 0
+	}
+	return f.visible(cfg.Env)
+}
+
+// maxFigureSuggestions caps the close matches suggested for an unknown figure
+const maxFigureSuggestions = 3
+
+// figureSuggestions returns the visible catalog figures a name is close to, closest first: names within an
+// edit distance of a third of the name's length, and names containing it ("einstein" for Albert Einstein)
+func figureSuggestions(cfg *Config, name string) []string {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	if name == "" {
+		return []string{}
+	}
+
+	type match struct {
+		name     string
+		distance int
+	}
+	var matches []match
+	for _, f := range figureCatalog {
+		if !f.visible(cfg.Env) {
+			continue
+		}
+		candidate := strings.ToLower(f.Name)
+		distance := editDistance(name, candidate)
+		contained := len(name) >= 4 && strings.Contains(candidate, name)
+		if distance <= max(1, len([]rune(name))/3) || contained {
+			matches = append(matches, match{name: f.Name, distance: distance})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+
+	suggestions := []string{}
+	for _, m := range matches[:min(len(matches), maxFigureSuggestions)] {
+		suggestions = append(suggestions, m.name)
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between two strings, counted in runes
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// respondUnknownFigure answers a request for a figure that isn't available with the catalog figures it is close to
+func respondUnknownFigure(c *gin.Context, cfg *Config, name string) {
+	c.JSON(http.StatusNotFound, gin.H{"error": "unknown_figure", "suggestions": figureSuggestions(cfg, name)})
+}
+
+// referenceFigure validates a request to have a figure explain another figure's ideas, both must be
+// catalog figures visible in this environment and differ. It returns the reference's canonical name
+func referenceFigure(figure string, reference string, env string) (string, bool) {
+	f, ok := lookupFigure(figure)
+	if !ok || !f.visible(env) {
+		return "", false
+	}
+	ref, ok := lookupFigure(reference)
+	if !ok || !ref.visible(env) || ref.Name == f.Name {
+		return "", false
+	}
+	return ref.Name, true
+}
+
+// visibleFigures summarizes the catalog figures that may be served in the current ENV
+func visibleFigures(env string) []FigureSummary {
+	figures := []FigureSummary{}
+	for _, f := range figureCatalog {
+		if !f.visible(env) {
+			continue
+		}
+		summary := FigureSummary{Name: f.Name, Modes: []Mode{}, AnyMode: f.AnyMode}
+		for mode := range f.Modes {
+			summary.Modes = append(summary.Modes, mode)
+		}
+		sort.Slice(summary.Modes, func(i, j int) bool { return summary.Modes[i] < summary.Modes[j] })
+		figures = append(figures, summary)
+	}
+	return figures
+}
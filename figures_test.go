@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withFigures adds figures to the catalog for the duration of the test
+func withFigures(t *testing.T, figures ...Figure) {
+	t.Helper()
+	catalog := figureCatalog
+	figureCatalog = append(append([]Figure(nil), catalog...), figures...)
+	t.Cleanup(func() { figureCatalog = catalog })
+}
+
+// experimentalFigure is a persona still being staged
+var experimentalFigure = Figure{
+	Name:       "Ada Lovelace",
+	Visibility: VisibilityExperimental,
+	Modes: map[Mode]ModeConfig{
+		ModeLesson: {Template: `You are Ada Lovelace, teaching about "{topic}". {ending}`},
+	},
+}
+
+func TestExperimentalFigures(t *testing.T) {
+	withFigures(t, experimentalFigure)
+	tests := []struct {
+		env     string
+		visible bool
+	}{
+		{"", false},
+		{"production", false},
+		{"staging", true},
+		{"development", true},
+	}
+	for _, tt := range tests {
+		t.Run("env "+tt.env, func(t *testing.T) {
+			cfg := testConfig(t, "ENV", tt.env)
+			listed := false
+			for _, f := range visibleFigures(tt.env) {
+				listed = listed || f.Name == experimentalFigure.Name
+			}
+			if listed != tt.visible {
+				t.Errorf("listed in /api/figures = %v, want %v", listed, tt.visible)
+			}
+			if available := figureAvailable(cfg, experimentalFigure.Name); available != tt.visible {
+				t.Errorf("figureAvailable = %v, want %v", available, tt.visible)
+			}
+			// Public figures and figures outside the catalog are always served
+			if !figureAvailable(cfg, "Aristotle") || !figureAvailable(cfg, "Hypatia") {
+				t.Error("a public or generic figure isn't available")
+			}
+		})
+	}
+}
+
+func TestCanonicalFigure(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Aristotle", "Aristotle"},
+		{"aristotle", "Aristotle"},
+		{"ARISTOTLE", "Aristotle"},
+		{"  aRiStOtLe ", "Aristotle"},
+		{"el arroyo sign", "El Arroyo Sign"},
+		{"  Ada Lovelace ", "Ada Lovelace"},
+	}
+	for _, tt := range tests {
+		if got := canonicalFigure(tt.name); got != tt.want {
+			t.Errorf("canonicalFigure(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFigureSuggestions(t *testing.T) {
+	cfg := testConfig(t, "ENV", "production")
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"aristotel", []string{"Aristotle"}},
+		{"  Confucious ", []string{"Confucius"}},
+		{"einstein", []string{"Albert Einstein"}},
+		{"Plato", []string{}},
+		{"Jimi Hendrix", []string{}},
+		// Hidden figures aren't suggested
+		{"Ada Lovelac", []string{}},
+		{"", []string{}},
+	}
+	withFigures(t, experimentalFigure)
+	for _, tt := range tests {
+		if got := figureSuggestions(cfg, tt.name); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("figureSuggestions(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChatMixedCaseFigure(t *testing.T) {
+	cfg := testConfig(t)
+	for _, name := range []string{"aristotle", "ARISTOTLE", " Aristotle "} {
+		client := &fakeChatClient{deltas: []string{"Hello."}}
+		w := serve(chatHandler(client, cfg), `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":`+jsonString(name)+`}`)
+
+		if !strings.Contains(w.Body.String(), `"type":"meta","figure":"Aristotle"`) {
+			t.Errorf("%q: meta doesn't carry the canonical name:\n%s", name, w.Body)
+		}
+		// The figure keeps its own persona rather than the generic one
+		if prompt := client.lastRequest(t).Messages[0].Content; !strings.HasPrefix(prompt, "You are Aristotle, the ancient Greek philosopher.") {
+			t.Errorf("%q: prompt = %q", name, prompt)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// chatHandler handles /api/chat, streaming the figure's reply to the conversation so far
+func chatHandler(client ChatClient, cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqBody ChatRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		req, conv, ok := prepareChat(c, cfg, &reqBody)
+		if !ok {
+			return
+		}
+
+		if reqBody.Candidates > 1 {
+			respondWithCandidates(c, cfg, client, req, reqBody.Candidates)
+			return
+		}
+
+		if reqBody.Variations > 1 {
+			respondWithVariations(c, cfg, client, req, reqBody.Variations)
+			return
+		}
+
+		result := streamCompletion(c, cfg, client, req, streamOptions{
+			figure:             reqBody.SelectedFigure,
+			mode:               reqBody.Mode,
+			conversationID:     reqBody.ConversationID,
+			includeSuggestions: reqBody.IncludeSuggestions,
+		})
+
+		if conv != nil && result.content != "" {
+			conv.Messages = append(reqBody.Messages, Message{Role: openai.ChatMessageRoleAssistant, Content: result.content})
+			conversations.save(*conv, cfg.MaxConversations)
+		}
+	}
+}
+
+// prepareChat validates a chat request and builds the completion request for it, along with the stored
+// conversation it continues if any. On failure it has already responded and returns false
+func prepareChat(c *gin.Context, cfg *Config, reqBody *ChatRequestBody) (req openai.ChatCompletionRequest, conv *Conversation, ok bool) {
+	reqBody.SelectedFigure = canonicalFigure(reqBody.SelectedFigure)
+	tagRequest(c, reqBody.SelectedFigure, reqBody.Mode)
+
+	if err := reqBody.Mode.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode"})
+		return req, nil, false
+	}
+
+	if !modeSupported(reqBody.SelectedFigure, reqBody.Mode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode_not_supported"})
+		return req, nil, false
+	}
+
+	var conflict bool
+	reqBody.Messages, conflict = mergeMessageField(reqBody.Message, reqBody.Messages)
+	if conflict {
+		fmt.Printf("Warning: request %s sent message and messages that disagree, using messages\n", c.GetString("requestID"))
+	}
+
+	if !hasUserContent(reqBody.Messages) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty_message"})
+		return req, nil, false
+	}
+
+	if rule := bannedTopic(cfg.BannedTopics, reqBody.SelectedTopic, latestUserMessage(reqBody.Messages)); rule != "" {
+		fmt.Printf("Blocked banned topic %q for request %s\n", rule, c.GetString("requestID"))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "topic_not_allowed"})
+		return req, nil, false
+	}
+
+	if reqBody.Candidates < 0 || reqBody.Candidates > cfg.MaxCandidates {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid candidates count"})
+		return req, nil, false
+	}
+
+	// Candidates aren't saved since the client picks one, so they can't continue a stored conversation
+	if reqBody.Candidates > 1 && reqBody.ConversationID != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Candidates can't be used with a conversation"})
+		return req, nil, false
+	}
+
+	if reqBody.MaxTokens < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid maxTokens"})
+		return req, nil, false
+	}
+
+	if reqBody.Variations != 0 {
+		config, _ := lookupModeConfig(reqBody.SelectedFigure, reqBody.Mode)
+		if config.MaxVariations == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "variations_not_supported"})
+			return req, nil, false
+		}
+		if reqBody.Variations < 1 || reqBody.Variations > config.MaxVariations || reqBody.Candidates > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("variations must be between 1 and %d, without candidates", config.MaxVariations)})
+			return req, nil, false
+		}
+		// Like candidates, variations aren't saved, so they can't continue a stored conversation
+		if reqBody.ConversationID != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Variations can't be used with a conversation"})
+			return req, nil, false
+		}
+	}
+
+	if !figureAvailable(cfg, reqBody.SelectedFigure) {
+		respondUnknownFigure(c, cfg, reqBody.SelectedFigure)
+		return req, nil, false
+	}
+
+	if !allowCustomFigure(c, cfg, reqBody.SelectedFigure) {
+		return req, nil, false
+	}
+
+	if _, ok := responseStyles[reqBody.Style]; reqBody.Style != "" && !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid style"})
+		return req, nil, false
+	}
+
+	if reqBody.ReferenceFigure != "" {
+		ref, ok := referenceFigure(reqBody.SelectedFigure, reqBody.ReferenceFigure, cfg.Env)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reference figure"})
+			return req, nil, false
+		}
+		reqBody.ReferenceFigure = ref
+	}
+
+	fmt.Println("Received message:", logContent(cfg, latestUserMessage(reqBody.Messages)))
+	fmt.Println("Mode:", reqBody.Mode)
+	fmt.Println("Figure:", reqBody.SelectedFigure)
+	fmt.Println("Topic:", reqBody.SelectedTopic)
+
+	params, err := resolveParams(reqBody.Profile, reqBody.SelectedFigure, reqBody.ModelParams)
+	if err != nil {
+		fmt.Println("Error resolving parameters:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid profile"})
+		return req, nil, false
+	}
+
+	// Continuing a stored conversation keeps the model it started with unless the request picks one.
+	// Another client's conversation is reported as not found, as if it didn't exist
+	requestedModel := reqBody.Model
+	if reqBody.ConversationID != "" {
+		if id, ok := clientConversationID(reqBody.ConversationID); ok {
+			reqBody.ConversationID = id
+		}
+		stored, ok := conversations.get(reqBody.ConversationID)
+		switch {
+		case ok && stored.Owner != "" && stored.Owner != clientID(c):
+			c.JSON(http.StatusConflict, gin.H{"error": "conversation_id_taken"})
+			return req, nil, false
+		case ok && stored.Client != clientID(c):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+			return req, nil, false
+		case ok:
+			conv = &stored
+			if requestedModel == "" {
+				requestedModel = conv.Model
+			}
+			if reqBody.Profile == "" && reqBody.ModelParams == (ModelParams{}) {
+				params = conv.Params
+			}
+		default:
+			// Clients may create conversations under their own UUIDs, other unknown IDs are errors
+			if _, isUUID := clientConversationID(reqBody.ConversationID); !isUUID {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+				return req, nil, false
+			}
+			conv = &Conversation{
+				ID:        reqBody.ConversationID,
+				Figure:    reqBody.SelectedFigure,
+				Mode:      reqBody.Mode,
+				Topic:     reqBody.SelectedTopic,
+				CreatedAt: time.Now(),
+				Owner:     clientID(c),
+				Client:    clientID(c),
+			}
+			fmt.Println("Creating conversation with client ID:", conv.ID)
+		}
+	}
+
+	model, err := resolveModel(cfg, requestedModel, reqBody.SelectedFigure, reqBody.Mode, permittedModels(c, cfg))
+	if err != nil {
+		respondModelError(c, err)
+		return req, nil, false
+	}
+	// A new standing instruction replaces the stored one, otherwise the stored one keeps applying
+	instruction := sanitizeInstruction(reqBody.ConversationInstruction, cfg.MaxConversationInstrChars)
+	if conv != nil {
+		if conv.Model == "" {
+			conv.Model = model
+		}
+		conv.Params = params
+		if instruction != "" {
+			conv.Instruction = instruction
+		}
+		instruction = conv.Instruction
+	}
+
+	// A replayed transcript may include a system prompt, ours is the only one sent
+	if stripped, n := stripSystemMessages(reqBody.Messages); n > 0 {
+		fmt.Printf("Stripped %d client system message(s) from request %s\n", n, c.GetString("requestID"))
+		reqBody.Messages = stripped
+	}
+
+	if cfg.CollapseDuplicateMessages {
+		collapsed := collapseDuplicateMessages(reqBody.Messages)
+		if dropped := len(reqBody.Messages) - len(collapsed); dropped > 0 {
+			fmt.Printf("Collapsed %d duplicate user message(s)\n", dropped)
+		}
+		reqBody.Messages = collapsed
+	}
+
+	// Only the ALLOWED_CLIENT_ROLES turns may come from the client, the system prompt is ours
+	for _, msg := range reqBody.Messages {
+		if !cfg.AllowedClientRoles[msg.Role] {
+			fmt.Println("Rejected message with role:", msg.Role)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role_not_allowed", "role": msg.Role, "allowedRoles": allowedRoles(cfg)})
+			return req, nil, false
+		}
+	}
+
+	// A stored conversation's history is the server's, the client only adds the next user turn
+	if conv != nil {
+		reqBody.Messages = continueHistory(conv.Messages, reqBody.Messages)
+	}
+
+	logMessages(cfg, c.GetString("requestID"), reqBody.Messages)
+
+	opts := reqBody.promptOptions()
+	if reqBody.IncludeReflection {
+		// The reflective question replaces the interactive instruction's questions rather than adding to them
+		opts.interactive = false
+	}
+	prompt := getSystemPrompt(cfg, reqBody.SelectedFigure, reqBody.Mode, reqBody.SelectedTopic, opts)
+	appendStyle(prompt, reqBody.SelectedFigure, reqBody.Style)
+	if reqBody.IncludeReflection {
+		appendReflection(prompt, reqBody.SelectedTopic)
+	}
+	appendSceneSetting(prompt, reqBody.SelectedFigure, reqBody.Mode, reqBody.Messages)
+	appendReferenceFigure(prompt, reqBody.SelectedFigure, reqBody.ReferenceFigure)
+	appendConversationInstruction(prompt, instruction)
+	appendExtraInstructions(cfg, prompt, reqBody.ExtraInstructions)
+	if reqBody.Variations > 1 {
+		appendVariations(prompt, reqBody.Variations)
+	}
+	systemPrompt := prompt.render(cfg.MaxSystemPromptChars)
+
+	// Convert client messages to OpenAI messages
+	var messages []openai.ChatCompletionMessage
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: systemPrompt,
+	})
+
+	names := newMessageNames()
+	for _, msg := range reqBody.Messages {
+		message := openai.ChatCompletionMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		}
+		if msg.Name != "" {
+			message.Name = names.slug(msg.Name)
+		}
+		messages = append(messages, message)
+	}
+	// The meta event maps the message names sent upstream back to the participants' names
+	c.Set("messageNames", names.display)
+
+	messages = insertPersonaReminders(messages, reqBody.SelectedFigure, cfg.PersonaReminderTurns)
+
+	// A focus update follows the history so it steers the next reply, the persona prompt stays first
+	if update := getSystemUpdate(cfg, reqBody.SelectedFigure, reqBody.SystemUpdate); update != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: update,
+		})
+	}
+
+	req = openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   true,
+	}
+	params = scheduleTemperature(cfg, params, reqBody.SelectedFigure, reqBody.Mode, userTurns(reqBody.Messages))
+	params.apply(&req)
+	applyMaxTokens(&req, reqBody.SelectedFigure, reqBody.Mode, reqBody.MaxTokens)
+
+	dropped, fits := fitContext(cfg, &req, prompt)
+	if !fits {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message_too_long"})
+		return req, nil, false
+	}
+	// The meta event tells the client how much of the history the figure didn't see
+	c.Set("historyDropped", dropped)
+
+	logResolved(c.GetString("requestID"), reqBody.SelectedFigure, reqBody.Mode, params, req)
+	return req, conv, true
+}
+
+// startDialogueHandler handles /api/start-dialogue, streaming the figure's opening message
+func startDialogueHandler(client ChatClient, cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqBody StartDialogueRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		reqBody.Figure = canonicalFigure(reqBody.Figure)
+		tagRequest(c, reqBody.Figure, reqBody.Mode)
+
+		if err := reqBody.Mode.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode"})
+			return
+		}
+
+		if !modeSupported(reqBody.Figure, reqBody.Mode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mode_not_supported"})
+			return
+		}
+
+		if rule := bannedTopic(cfg.BannedTopics, reqBody.Topic); rule != "" {
+			fmt.Printf("Blocked banned topic %q for request %s\n", rule, c.GetString("requestID"))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "topic_not_allowed"})
+			return
+		}
+
+		if !figureAvailable(cfg, reqBody.Figure) {
+			respondUnknownFigure(c, cfg, reqBody.Figure)
+			return
+		}
+
+		if !allowCustomFigure(c, cfg, reqBody.Figure) {
+			return
+		}
+
+		if _, ok := responseStyles[reqBody.Style]; reqBody.Style != "" && !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid style"})
+			return
+		}
+
+		if reqBody.ReferenceFigure != "" {
+			ref, ok := referenceFigure(reqBody.Figure, reqBody.ReferenceFigure, cfg.Env)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reference figure"})
+				return
+			}
+			reqBody.ReferenceFigure = ref
+		}
+
+		fmt.Printf("Starting dialogue with %s in mode %s on topic %s\n", reqBody.Figure, reqBody.Mode, reqBody.Topic)
+
+		params, err := resolveParams(reqBody.Profile, reqBody.Figure, reqBody.ModelParams)
+		if err != nil {
+			fmt.Println("Error resolving parameters:", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid profile"})
+			return
+		}
+
+		model, err := resolveModel(cfg, reqBody.Model, reqBody.Figure, reqBody.Mode, permittedModels(c, cfg))
+		if err != nil {
+			respondModelError(c, err)
+			return
+		}
+
+		opts := reqBody.promptOptions()
+		opts.greeting = true
+		prompt := getSystemPrompt(cfg, reqBody.Figure, reqBody.Mode, reqBody.Topic, opts)
+		appendGreetingInstruction(cfg, prompt)
+		appendSceneSetting(prompt, reqBody.Figure, reqBody.Mode, nil)
+		appendStyle(prompt, reqBody.Figure, reqBody.Style)
+		appendReferenceFigure(prompt, reqBody.Figure, reqBody.ReferenceFigure)
+		instruction := sanitizeInstruction(reqBody.ConversationInstruction, cfg.MaxConversationInstrChars)
+		appendConversationInstruction(prompt, instruction)
+		appendExtraInstructions(cfg, prompt, reqBody.ExtraInstructions)
+		systemPrompt := prompt.render(cfg.MaxSystemPromptChars)
+
+		messages := []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: systemPrompt,
+			},
+		}
+
+		req := openai.ChatCompletionRequest{
+			Model:    model,
+			Messages: messages,
+			Stream:   true,
+		}
+		params.apply(&req)
+		// The greeting has its own length, independent of the mode's limit for later turns, within the figure's budget
+		applyMaxTokens(&req, reqBody.Figure, reqBody.Mode, cfg.GreetingMaxTokens)
+		logResolved(c.GetString("requestID"), reqBody.Figure, reqBody.Mode, params, req)
+
+		// Every dialogue starts a stored conversation that locks in the model
+		conv := Conversation{
+			ID:          newRequestID(),
+			Figure:      reqBody.Figure,
+			Mode:        reqBody.Mode,
+			Topic:       reqBody.Topic,
+			Model:       model,
+			Params:      params,
+			Instruction: instruction,
+			CreatedAt:   time.Now(),
+			Client:      clientID(c),
+		}
+
+		result := streamCompletion(c, cfg, client, req, streamOptions{figure: reqBody.Figure, mode: reqBody.Mode, conversationID: conv.ID})
+
+		if result.content != "" {
+			conv.Messages = []Message{{Role: openai.ChatMessageRoleAssistant, Content: result.content}}
+			conversations.save(conv, cfg.MaxConversations)
+			trending.add(reqBody.Figure)
+		}
+	}
+}
+
+// testFigureHandler handles /api/admin/test-figure, running a single non-streaming completion for tuning personas
+func testFigureHandler(client ChatClient, cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqBody TestFigureRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil || reqBody.Message == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		reqBody.Figure = canonicalFigure(reqBody.Figure)
+
+		if err := reqBody.Mode.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode"})
+			return
+		}
+
+		if !modeSupported(reqBody.Figure, reqBody.Mode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mode_not_supported"})
+			return
+		}
+
+		params, err := resolveParams(reqBody.Profile, reqBody.Figure, reqBody.ModelParams)
+		if err != nil {
+			fmt.Println("Error resolving parameters:", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid profile"})
+			return
+		}
+
+		model, err := resolveModel(cfg, reqBody.Model, reqBody.Figure, reqBody.Mode, nil)
+		if err != nil {
+			respondModelError(c, err)
+			return
+		}
+
+		systemPrompt := getSystemPrompt(cfg, reqBody.Figure, reqBody.Mode, reqBody.Topic, reqBody.promptOptions()).render(cfg.MaxSystemPromptChars)
+
+		req := openai.ChatCompletionRequest{
+			Model: model,
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: systemPrompt},
+				{Role: openai.ChatMessageRoleUser, Content: reqBody.Message},
+			},
+		}
+		params.apply(&req)
+		applyMaxTokens(&req, reqBody.Figure, reqBody.Mode, 0)
+		logResolved(c.GetString("requestID"), reqBody.Figure, reqBody.Mode, params, req)
+
+		resp, err := client.CreateChatCompletion(c.Request.Context(), req)
+		if err != nil || len(resp.Choices) == 0 {
+			fmt.Println("Error creating completion:", err)
+			respondUpstreamError(c, err, "Error generating response")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"prompt":   systemPrompt,
+			"response": resp.Choices[0].Message.Content,
+			"usage":    resp.Usage,
+		})
+	}
+}
+
+// openingQuestionsHandler handles /api/opening-questions, suggesting questions to start a dialogue with
+func openingQuestionsHandler(client ChatClient, cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqBody OpeningQuestionsRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil || reqBody.Figure == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		reqBody.Figure = canonicalFigure(reqBody.Figure)
+
+		if err := reqBody.Mode.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode"})
+			return
+		}
+
+		if !modeSupported(reqBody.Figure, reqBody.Mode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mode_not_supported"})
+			return
+		}
+
+		if rule := bannedTopic(cfg.BannedTopics, reqBody.Topic); rule != "" {
+			fmt.Printf("Blocked banned topic %q for request %s\n", rule, c.GetString("requestID"))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "topic_not_allowed"})
+			return
+		}
+
+		if !figureAvailable(cfg, reqBody.Figure) {
+			respondUnknownFigure(c, cfg, reqBody.Figure)
+			return
+		}
+
+		questions, err := getOpeningQuestions(c.Request.Context(), client, cfg.SuggestionsModel, reqBody.Figure, reqBody.Mode, reqBody.Topic)
+		if err != nil {
+			fmt.Println("Error generating opening questions:", err)
+			respondUpstreamError(c, err, "Error generating questions")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"questions": questions})
+	}
+}
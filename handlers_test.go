@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestChatHandlerStreams(t *testing.T) {
+	cfg := testConfig(t)
+	deltas := []string{"Know ", "thyself. ", "学而时习之 🙂👍🏽", " Café & <b>naïve</b>"}
+	client := &fakeChatClient{deltas: deltas}
+
+	w := serve(chatHandler(client, cfg), `{"message":"Who are you?","messages":[{"role":"user","content":"Who are you?"}],"mode":"socratic","selectedFigure":"Aristotle"}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	types, text := eventTypes(sseEvents(t, w.Body.String()))
+	if want := strings.Join(deltas, ""); text != want {
+		t.Errorf("streamed text = %q, want %q", text, want)
+	}
+	// Multibyte and HTML characters are written as they are, not as \u escapes
+	if !strings.Contains(w.Body.String(), `data: "学而时习之 🙂👍🏽"`) || !strings.Contains(w.Body.String(), `data: " Café & <b>naïve</b>"`) {
+		t.Errorf("deltas not written as is:\n%s", w.Body)
+	}
+	if strings.Join(types, ",") != "meta,done" {
+		t.Errorf("events = %v, want [meta done]", types)
+	}
+	if !strings.Contains(w.Body.String(), `data: {"type":"done","finishReason":"stop"}`) {
+		t.Errorf("no done event with the finish reason:\n%s", w.Body)
+	}
+	if !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+		t.Error("stream doesn't end with [DONE]")
+	}
+
+	req := client.lastRequest(t)
+	if req.Messages[0].Role != openai.ChatMessageRoleSystem || !strings.Contains(req.Messages[0].Content, "Aristotle") {
+		t.Errorf("first message isn't Aristotle's persona prompt: %+v", req.Messages[0])
+	}
+	if last := req.Messages[len(req.Messages)-1]; last.Content != "Who are you?" {
+		t.Errorf("last message = %q", last.Content)
+	}
+}
+
+func TestChatHandlerCandidates(t *testing.T) {
+	cfg := testConfig(t)
+	client := &fakeChatClient{replies: []string{"First.", "Second."}, usage: &openai.Usage{TotalTokens: 12}}
+
+	w := serve(chatHandler(client, cfg), `{"messages":[{"role":"user","content":"Hello"}],"mode":"socratic","selectedFigure":"Aristotle","candidates":2}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Candidates []Candidate  `json:"candidates"`
+		Usage      openai.Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Candidates) != 2 || body.Candidates[0].Content != "First." || body.Candidates[1].Content != "Second." {
+		t.Errorf("candidates = %+v", body.Candidates)
+	}
+	if body.Usage.TotalTokens != 12 {
+		t.Errorf("usage = %+v, want the completion's", body.Usage)
+	}
+	if req := client.lastRequest(t); req.Stream || req.N != 2 {
+		t.Errorf("request stream = %v, n = %d, want a non-streaming request for 2 choices", req.Stream, req.N)
+	}
+}
+
+func TestChatValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    []string
+		body   string
+		status int
+		error  string
+	}{
+		{"invalid JSON", nil, `{"message":`, http.StatusBadRequest, "Invalid request"},
+		{"no message", nil, `{"mode":"socratic","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "empty_message"},
+		{"whitespace message", nil, `{"message":" \n\t ","mode":"socratic","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "empty_message"},
+		{"whitespace turn", nil, `{"messages":[{"role":"user","content":"  "}],"mode":"socratic","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "empty_message"},
+		// messages wins over message, which can't stand in for the blank turn messages would send
+		{"message with a blank turn", nil, `{"message":"Hi","messages":[{"role":"user","content":"   "}],"mode":"socratic","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "empty_message"},
+		{"only an assistant turn", nil, `{"messages":[{"role":"assistant","content":"Hello."}],"mode":"socratic","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "empty_message"},
+		{"unknown mode", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"interrogation","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "Invalid mode"},
+		{"mode without template", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"lesson","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "mode_not_supported"},
+		{"hidden figure", []string{"ENV", "production"}, `{"messages":[{"role":"user","content":"Hi"}],"mode":"lesson","selectedFigure":"Ada Lovelace"}`, http.StatusNotFound, "unknown_figure"},
+		// A name close to a catalog figure is likely a misspelling, not a figure for the generic persona
+		{"misspelled figure", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"aristotel"}`, http.StatusNotFound, "unknown_figure"},
+		{"unknown figure with STRICT_FIGURES", []string{"STRICT_FIGURES", "true"}, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Hypatia"}`, http.StatusNotFound, "unknown_figure"},
+		// System messages are stripped, roles outside ALLOWED_CLIENT_ROLES are rejected
+		{"tool role", nil, `{"messages":[{"role":"tool","content":"{}"},{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "role_not_allowed"},
+		{"assistant turn forbidden", []string{"ALLOWED_CLIENT_ROLES", "user"}, `{"messages":[{"role":"user","content":"Hi"},{"role":"assistant","content":"Hello."},{"role":"user","content":"Go on"}],"mode":"socratic","selectedFigure":"Aristotle"}`, http.StatusBadRequest, "role_not_allowed"},
+		{"unknown profile", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Aristotle","profile":"chaotic"}`, http.StatusBadRequest, "Invalid profile"},
+		{"unknown style", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Aristotle","style":"limerick"}`, http.StatusBadRequest, "Invalid style"},
+		{"negative maxTokens", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Aristotle","maxTokens":-1}`, http.StatusBadRequest, "Invalid maxTokens"},
+		{"too many candidates", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Aristotle","candidates":9}`, http.StatusBadRequest, "Invalid candidates count"},
+		{"candidates in a conversation", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Aristotle","candidates":2,"conversationId":"c1"}`, http.StatusBadRequest, "Candidates can't be used with a conversation"},
+		{"variations in an unsupported mode", nil, `{"message":"Hi","mode":"socratic","selectedFigure":"Aristotle","variations":2}`, http.StatusBadRequest, "variations_not_supported"},
+		{"too many variations", nil, `{"message":"Hi","mode":"humor","selectedFigure":"El Arroyo Sign","variations":6}`, http.StatusBadRequest, "variations must be between 1 and 5, without candidates"},
+		{"negative variations", nil, `{"message":"Hi","mode":"humor","selectedFigure":"El Arroyo Sign","variations":-1}`, http.StatusBadRequest, "variations must be between 1 and 5, without candidates"},
+		{"variations with candidates", nil, `{"message":"Hi","mode":"humor","selectedFigure":"El Arroyo Sign","variations":2,"candidates":2}`, http.StatusBadRequest, "variations must be between 1 and 5, without candidates"},
+		{"variations in a conversation", nil, `{"message":"Hi","mode":"humor","selectedFigure":"El Arroyo Sign","variations":2,"conversationId":"c1"}`, http.StatusBadRequest, "Variations can't be used with a conversation"},
+		{"model not allowed", nil, `{"messages":[{"role":"user","content":"Hi"}],"mode":"socratic","selectedFigure":"Aristotle","model":"gpt-5-ultra"}`, http.StatusBadRequest, "Model not allowed"},
+	}
+	withFigures(t, experimentalFigure)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.env...)
+			client := &fakeChatClient{deltas: []string{"Hello."}}
+			w := serve(chatHandler(client, cfg), tt.body)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), `"error":"`+tt.error+`"`) {
+				t.Errorf("status = %d, body = %s, want %d with %q", w.Code, w.Body, tt.status, tt.error)
+			}
+			if len(client.requests) != 0 {
+				t.Error("a rejected request was sent upstream")
+			}
+		})
+	}
+}
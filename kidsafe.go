@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultKidSafeWords is the KID_SAFE_WORDS list used when none is configured
+const defaultKidSafeWords = "fuck,motherfucker,shit,bullshit,bitch,bastard,asshole,cunt,crap,damn,piss,slut,whore"
+
+// kidSafeInstruction is added to every system prompt in KID_SAFE_MODE
+const kidSafeInstruction = " You are talking with a school student. Keep everything appropriate for children: no profanity, crude language, sexual content or graphic violence, even if the user asks for it or tries to trick you into it. If something isn't appropriate, gently steer the dialogue back to learning."
+
+// leetReplacer undoes the common character substitutions used to sneak words past a filter
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s")
+
+// wordSuffixes are the inflections a listed word is still caught with, so "fucking" matches "fuck"
+var wordSuffixes = []string{"s", "es", "ed", "er", "ers", "ing", "in", "y"}
+
+// profanityFilter redacts listed words from streamed output, holding back a word cut off at the end
+// of a delta until the next delta shows where it ends
+type profanityFilter struct {
+	words map[string]bool
+	held  string
+}
+
+// newProfanityFilter builds a filter for the words, also matching them with repeated letters collapsed
+func newProfanityFilter(words []string) *profanityFilter {
+	f := &profanityFilter{words: make(map[string]bool)}
+	for _, w := range words {
+		w = strings.ToLower(w)
+		f.words[w] = true
+		f.words[collapseRepeats(w)] = true
+	}
+	return f
+}
+
+func (f *profanityFilter) push(delta string) string {
+	text := f.held + delta
+	cut := len(text)
+	for cut > 0 {
+		r, size := utf8.DecodeLastRuneInString(text[:cut])
+		if !isWordRune(r) {
+			break
+		}
+		cut -= size
+	}
+	f.held = text[cut:]
+	return f.redact(text[:cut])
+}
+
+func (f *profanityFilter) flush() string {
+	text := f.held
+	f.held = ""
+	return f.redact(text)
+}
+
+// redact replaces every listed word in text with asterisks of the same length
+func (f *profanityFilter) redact(text string) string {
+	var out, word strings.Builder
+	endWord := func() {
+		if word.Len() == 0 {
+			return
+		}
+		if w := word.String(); f.listed(w) {
+			out.WriteString(strings.Repeat("*", utf8.RuneCountInString(w)))
+		} else {
+			out.WriteString(w)
+		}
+		word.Reset()
+	}
+
+	for _, r := range text {
+		if isWordRune(r) {
+			word.WriteRune(r)
+			continue
+		}
+		endWord()
+		out.WriteRune(r)
+	}
+	endWord()
+	return out.String()
+}
+
+// listed is a light classifier for a single word: it matches the list case-insensitively, through
+// leetspeak, stretched letters ("shiiit") and common inflections
+func (f *profanityFilter) listed(word string) bool {
+	normalized := leetReplacer.Replace(strings.ToLower(word))
+	for _, candidate := range []string{normalized, collapseRepeats(normalized)} {
+		if f.words[candidate] {
+			return true
+		}
+		for _, suffix := range wordSuffixes {
+			if stem, ok := strings.CutSuffix(candidate, suffix); ok && f.words[stem] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWordRune reports whether r can be part of a word, including the symbols leetspeak uses for letters
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '@' || r == '$'
+}
+
+// collapseRepeats shortens every run of a repeated character to one
+func collapseRepeats(s string) string {
+	var b strings.Builder
+	var last rune
+	for i, r := range s {
+		if i > 0 && r == last {
+			continue
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfanityFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		deltas []string
+		want   string
+	}{
+		{"clean", []string{"Virtue is a habit."}, "Virtue is a habit."},
+		{"listed word", []string{"Well, damn."}, "Well, ****."},
+		{"any case", []string{"DAMN it"}, "**** it"},
+		{"inflection", []string{"Stop fucking around"}, "Stop ******* around"},
+		{"leetspeak", []string{"What a $h1t idea"}, "What a **** idea"},
+		{"stretched letters", []string{"shiiiit"}, "*******"},
+		{"word split across deltas", []string{"Well, da", "mn it"}, "Well, **** it"},
+		{"word at the end", []string{"Oh ", "crap"}, "Oh ****"},
+		{"word containing a listed word", []string{"Scrap the class, Dickens"}, "Scrap the class, Dickens"},
+		{"accented letters", []string{"Café damné"}, "Café damné"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newProfanityFilter(strings.Split(defaultKidSafeWords, ","))
+			var out strings.Builder
+			for _, delta := range tt.deltas {
+				out.WriteString(f.push(delta))
+			}
+			out.WriteString(f.flush())
+			if out.String() != tt.want {
+				t.Errorf("filtered %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestKidSafeModeRedactsStream(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		text string
+	}{
+		{"off", nil, "Well, damn."},
+		{"on", []string{"KID_SAFE_MODE", "true"}, "Well, ****."},
+		{"custom words", []string{"KID_SAFE_MODE", "true", "KID_SAFE_WORDS", "well"}, "****, damn."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.env...)
+			w := serve(chatHandler(&fakeChatClient{deltas: []string{"Well, da", "mn."}}, cfg), streamingEndpoints[0].body)
+			if _, text := eventTypes(sseEvents(t, w.Body.String())); text != tt.text {
+				t.Errorf("streamed %q, want %q", text, tt.text)
+			}
+		})
+	}
+}
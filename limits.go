@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamCounter counts the streams each client has open
+type streamCounter struct {
+	mu   sync.Mutex
+	open map[string]int
+}
+
+var openStreams = &streamCounter{open: make(map[string]int)}
+
+// acquire opens a stream for the client, false when it already has max open
+func (s *streamCounter) acquire(client string, max int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open[client] >= max {
+		return false
+	}
+	s.open[client]++
+	return true
+}
+
+// release closes one of the client's streams
+func (s *streamCounter) release(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open[client] <= 1 {
+		delete(s.open, client)
+		return
+	}
+	s.open[client]--
+}
+
+// limitStreams rejects requests from clients that already have MAX_STREAMS_PER_IP streams open, SSE
+// connections are long-lived so this is separate from rate limits. Clients are told apart by clientID, so
+// behind a router TRUSTED_PROXIES must list it or everyone shares one limit. 0 disables the limit
+func limitStreams(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.MaxStreamsPerIP == 0 {
+			c.Next()
+			return
+		}
+
+		client := clientID(c)
+		if !openStreams.acquire(client, cfg.MaxStreamsPerIP) {
+			respondRateLimited(c, rateLimitGateway, "too_many_streams", 5*time.Second)
+			return
+		}
+		// The handler returns once the stream has ended, however it ended
+		defer openStreams.release(client)
+		c.Next()
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// blockingStreams mounts limitStreams in front of a handler that holds each request open until released
+func blockingStreams(cfg *Config) (app *gin.Engine, entered chan struct{}, release chan struct{}) {
+	entered, release = make(chan struct{}, 10), make(chan struct{})
+	app = gin.New()
+	app.SetTrustedProxies(cfg.TrustedProxies)
+	app.POST("/", identifyClient(cfg), limitStreams(cfg), func(c *gin.Context) {
+		entered <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	return app, entered, release
+}
+
+// openStream sends a request through app from the address, forwarded for the client when set
+func openStream(app *gin.Engine, addr string, forwardedFor string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = addr + ":1234"
+	if forwardedFor != "" {
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
+
+func TestLimitStreamsPerClient(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       []string
+		addr      string
+		forwarded []string
+		// rejected is how many of the extra streams, one per forwarded client, are turned away
+		rejected int
+	}{
+		{"same address", nil, "192.0.2.20", []string{"", "", ""}, 1},
+		{"untrusted router", nil, "10.0.0.1", []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"}, 1},
+		{"trusted router", []string{"TRUSTED_PROXIES", "10.0.0.0/8"}, "10.0.0.2", []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, append([]string{"MAX_STREAMS_PER_IP", "2"}, tt.env...)...)
+			app, entered, release := blockingStreams(cfg)
+
+			// Hold the limit's worth of streams open, from the first two clients
+			var wg sync.WaitGroup
+			for _, forwarded := range tt.forwarded[:2] {
+				wg.Add(1)
+				go func(forwarded string) {
+					defer wg.Done()
+					openStream(app, tt.addr, forwarded)
+				}(forwarded)
+				<-entered
+			}
+
+			rejected := 0
+			done := make(chan *httptest.ResponseRecorder)
+			go func() { done <- openStream(app, tt.addr, tt.forwarded[2]) }()
+			select {
+			case w := <-done:
+				if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "too_many_streams") {
+					t.Fatalf("status = %d, want 429 too_many_streams: %s", w.Code, w.Body)
+				}
+				rejected++
+			case <-entered:
+				close(release)
+				<-done
+			}
+			if rejected != tt.rejected {
+				t.Errorf("rejected %d streams, want %d", rejected, tt.rejected)
+			}
+			if rejected > 0 {
+				close(release)
+			}
+			wg.Wait()
+
+			// Closed streams free their slots
+			if len(openStreams.open) != 0 {
+				t.Errorf("open streams after closing = %v", openStreams.open)
+			}
+		})
+	}
+}
+
+func TestLimitStreamsReleasedOnDisconnect(t *testing.T) {
+	cfg := testConfig(t, "MAX_STREAMS_PER_IP", "1")
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		client := &fakeChatClient{deltas: []string{"Virtue ", "is a habit."}, hangUp: cancel}
+		app := gin.New()
+		app.POST("/", requestID(), limitStreams(cfg), chatHandler(client, cfg))
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"message":"Hello","mode":"socratic","selectedFigure":"Aristotle"}`)).WithContext(ctx)
+		r.RemoteAddr = "192.0.2.21:1234"
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		cancel()
+
+		// The second stream only gets through if the disconnected one gave its slot back
+		if w.Code != http.StatusOK {
+			t.Fatalf("stream %d: status = %d, want 200", i+1, w.Code)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// logContent formats message content for the logs, hashed when LOG_REDACT_CONTENT is set and
+// otherwise truncated to LOG_MAX_MESSAGE_CHARS characters
+func logContent(cfg *Config, content string) string {
+	if cfg.LogRedactContent {
+		sum := sha256.Sum256([]byte(content))
+		return fmt.Sprintf("[redacted sha256:%s len:%d]", hex.EncodeToString(sum[:])[:12], len(content))
+	}
+
+	maxChars := cfg.LogMaxMessageChars
+	if runes := []rune(content); len(runes) > maxChars {
+		return fmt.Sprintf("%s... (%d more characters)", string(runes[:maxChars]), len(runes)-maxChars)
+	}
+	return content
+}
+
+// logMessages prints the LOG_MAX_MESSAGES most recent messages of a conversation when DEBUG is enabled
+func logMessages(cfg *Config, requestID string, messages []Message) {
+	if !cfg.Debug {
+		return
+	}
+
+	maxMessages := cfg.LogMaxMessages
+	start := 0
+	if len(messages) > maxMessages {
+		start = len(messages) - maxMessages
+	}
+
+	fmt.Printf("Conversation for request %s (%d messages, showing %d)\n", requestID, len(messages), len(messages)-start)
+	for i := start; i < len(messages); i++ {
+		fmt.Printf("  [%d] %s: %s\n", i, messages[i].Role, logContent(cfg, messages[i].Content))
+	}
+}
+
+// resolvedRequest is the request_resolved log event, the settings a completion actually ran with
+// after defaults, profiles and overrides were applied. Nil parameters use the model defaults
+type resolvedRequest struct {
+	Event     string `json:"event"`
+	RequestID string `json:"requestId"`
+	Figure    string `json:"figure"`
+	Mode      Mode   `json:"mode"`
+	Model     string `json:"model"`
+	MaxTokens int    `json:"maxTokens,omitempty"`
+	// PromptVersion is a hash of the system prompt, equal hashes mean the same prompt was used
+	PromptVersion string `json:"promptVersion"`
+	ModelParams
+}
+
+// logResolved prints a single JSON request_resolved line for a completion request
+func logResolved(requestID string, figure string, mode Mode, params ModelParams, req openai.ChatCompletionRequest) {
+	var systemPrompt string
+	if len(req.Messages) > 0 {
+		systemPrompt = req.Messages[0].Content
+	}
+	sum := sha256.Sum256([]byte(systemPrompt))
+
+	line, err := jsonEncode(resolvedRequest{
+		Event:         "request_resolved",
+		RequestID:     requestID,
+		Figure:        figure,
+		Mode:          mode,
+		Model:         req.Model,
+		MaxTokens:     req.MaxTokens,
+		PromptVersion: hex.EncodeToString(sum[:])[:12],
+		ModelParams:   params,
+	})
+	if err != nil {
+		fmt.Println("Error encoding request_resolved:", err)
+		return
+	}
+	fmt.Println(string(line))
+}
+
+// completionTiming is the completion_timing log event, splitting a streamed completion's latency into
+// connecting (the CreateChatCompletionStream call) and generating (receiving the deltas until the end)
+type completionTiming struct {
+	Event     string `json:"event"`
+	RequestID string `json:"requestId"`
+	Model     string `json:"model"`
+	ConnectMs int64  `json:"connectMs"`
+	// FirstTokenMs is how long after connecting the first delta arrived, absent when none did
+	FirstTokenMs *int64 `json:"firstTokenMs,omitempty"`
+	GenerateMs   int64  `json:"generateMs"`
+	Deltas       int    `json:"deltas"`
+}
+
+// logCompletionTiming prints a single JSON completion_timing line for a relayed stream, connected is when
+// CreateChatCompletionStream returned after taking connect
+func logCompletionTiming(requestID string, model string, connect time.Duration, connected time.Time, result streamResult) {
+	timing := completionTiming{
+		Event:      "completion_timing",
+		RequestID:  requestID,
+		Model:      model,
+		ConnectMs:  connect.Milliseconds(),
+		GenerateMs: time.Since(connected).Milliseconds(),
+		Deltas:     result.deltas,
+	}
+	if !result.firstDelta.IsZero() {
+		firstToken := result.firstDelta.Sub(connected).Milliseconds()
+		timing.FirstTokenMs = &firstToken
+	}
+
+	line, err := jsonEncode(timing)
+	if err != nil {
+		fmt.Println("Error encoding completion_timing:", err)
+		return
+	}
+	fmt.Println(string(line))
+}
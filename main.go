@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"os"
-	"time"
+	"strconv"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -13,11 +16,19 @@ import (
 	openai "github.com/sashabaranov/go-openai"
 )
 
-// Load environment variables from .env file
+// Load environment variables from .env file. Variables already set in the environment take precedence,
+// and without a .env file, the normal case in production, the process environment is used as is
 func init() {
 	err := godotenv.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		// The config isn't loaded yet, so DEBUG is read directly
+		if debug, _ := strconv.ParseBool(os.Getenv("DEBUG")); debug {
+			fmt.Println("No .env file, using the process environment")
+		}
+		return
+	}
 	if err != nil {
-		fmt.Println("No .env file found or error reading .env file")
+		fmt.Println("Error reading .env file, using the process environment:", err)
 	}
 }
 
@@ -28,188 +39,225 @@ type Message struct {
 	Name    string `json:"name,omitempty"`
 }
 
+// clientRoles are the message roles ALLOWED_CLIENT_ROLES may let clients send, the system prompt is always ours
+var clientRoles = map[string]bool{
+	openai.ChatMessageRoleUser:      true,
+	openai.ChatMessageRoleAssistant: true,
+}
+
 // ChatRequestBody represents the request body for /api/chat
 type ChatRequestBody struct {
-	Message        string    `json:"message"`
-	Messages       []Message `json:"messages"`
-	Mode           string    `json:"mode"`
-	SelectedFigure string    `json:"selectedFigure"`
-	SelectedTopic  string    `json:"selectedTopic,omitempty"`
+	// Message is a single user turn for requests without a history. When Messages is also sent, Messages
+	// wins and Message is ignored, with a warning logged if it isn't Messages' last user turn
+	Message            string    `json:"message"`
+	Messages           []Message `json:"messages"`
+	Mode               Mode      `json:"mode"`
+	SelectedFigure     string    `json:"selectedFigure"`
+	SelectedTopic      string    `json:"selectedTopic,omitempty"`
+	Profile            string    `json:"profile,omitempty"`
+	ExtraInstructions  string    `json:"extraInstructions,omitempty"`
+	IncludeSuggestions bool      `json:"includeSuggestions,omitempty"`
+	SystemUpdate       string    `json:"systemUpdate,omitempty"`
+	Candidates         int       `json:"candidates,omitempty"`
+	// ConversationID continues a stored conversation. An unknown ID that is a UUID creates the conversation
+	// under that ID, so offline clients can name conversations themselves: the first turn creates, later
+	// turns append. A UUID already taken by another client is rejected. A stored conversation's history is
+	// kept by the server, of the messages sent only the last user turn is added to it
+	ConversationID string `json:"conversationId,omitempty"`
+	Model          string `json:"model,omitempty"`
+	// ReferenceFigure is another catalog figure whose ideas the figure explains in its own voice
+	ReferenceFigure string `json:"referenceFigure,omitempty"`
+	// Style overrides the figure's response style, one of responseStyles
+	Style string `json:"style,omitempty"`
+	// ConversationInstruction is a standing instruction for the whole conversation, stored with it so
+	// later turns keep it without resending. Sending a new one replaces it
+	ConversationInstruction string `json:"conversationInstruction,omitempty"`
+	// MaxTokens overrides the figure's response length, it can't exceed the figure's response token budget
+	MaxTokens int `json:"maxTokens,omitempty"`
+	// IncludeReflection has the figure end with one open-ended reflective question for the user, in place of
+	// the interactive instruction's questions
+	IncludeReflection bool `json:"includeReflection,omitempty"`
+	// Variations asks for several distinct replies at once, returned as a list instead of a stream.
+	// Only modes with maxVariations support it
+	Variations int `json:"variations,omitempty"`
+	ModelParams
+	InstructionFlags
 }
 
 // StartDialogueRequestBody represents the request body for /api/start-dialogue
 type StartDialogueRequestBody struct {
+	Figure            string `json:"figure"`
+	Mode              Mode   `json:"mode"`
+	Topic             string `json:"topic"`
+	Profile           string `json:"profile,omitempty"`
+	ExtraInstructions string `json:"extraInstructions,omitempty"`
+	Model             string `json:"model,omitempty"`
+	ReferenceFigure   string `json:"referenceFigure,omitempty"`
+	Style             string `json:"style,omitempty"`
+	// ConversationInstruction is stored with the dialogue's conversation and applies on every turn
+	ConversationInstruction string `json:"conversationInstruction,omitempty"`
+	ModelParams
+	InstructionFlags
+}
+
+// TestFigureRequestBody represents the request body for /api/admin/test-figure
+type TestFigureRequestBody struct {
+	Figure  string `json:"figure"`
+	Mode    Mode   `json:"mode"`
+	Topic   string `json:"topic"`
+	Message string `json:"message"`
+	Profile string `json:"profile,omitempty"`
+	Model   string `json:"model,omitempty"`
+	ModelParams
+	InstructionFlags
+}
+
+// OpeningQuestionsRequestBody represents the request body for /api/opening-questions
+type OpeningQuestionsRequestBody struct {
 	Figure string `json:"figure"`
-	Mode   string `json:"mode"`
+	Mode   Mode   `json:"mode"`
 	Topic  string `json:"topic"`
 }
 
+// AbortRequestBody represents the request body for /api/chat/abort
+type AbortRequestBody struct {
+	RequestID string `json:"requestId"`
+}
+
 func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	app := gin.Default()
-	app.SetTrustedProxies(nil)
+	// Only the proxies in TRUSTED_PROXIES may set the client IP through X-Forwarded-For
+	app.SetTrustedProxies(cfg.TrustedProxies)
+	app.Use(identifyClient(cfg))
 
 	// Define CORS options
 	corsConfig := cors.Config{
-		AllowOrigins:     []string{"http://localhost:3000", "https://emersoncoronel.com"},
+		AllowOrigins:     cfg.AllowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
-		AllowHeaders:     []string{"Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Content-Type", "Authorization", apiKeyHeader},
+		ExposeHeaders:    []string{requestIDHeader},
 		AllowCredentials: true,
 	}
 
 	app.Use(cors.New(corsConfig))
+	app.Use(requestID())
+	app.Use(responseHeaders(cfg))
+
+	client := newOpenAIClient(cfg)
+	selfTest(client, cfg)
+	warmUp(client, cfg)
+
+	maintenance.set(cfg.MaintenanceMode, cfg.MaintenanceMessage)
+	loadFigureCatalog(cfg)
+	loadTrending(cfg)
+	go flushTrending(cfg)
+	loadUsage(cfg)
+	go flushUsage(cfg)
+
+	// Readiness endpoint, fails when the prompts config didn't load correctly
+	app.GET("/ready", func(c *gin.Context) {
+		if problems := checkCatalog(cfg); len(problems) > 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not_ready", "figures": len(figureCatalog), "problems": problems})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready", "figures": len(figureCatalog)})
+	})
 
-	openaiAPIKey := os.Getenv("OPENAI_API_KEY")
-	if openaiAPIKey == "" {
-		fmt.Println("OPENAI_API_KEY environment variable not set")
-		os.Exit(1)
-	}
+	// Figures endpoint, lists the figures available in this environment
+	app.GET("/api/figures", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"figures": visibleFigures(cfg.Env)})
+	})
 
-	client := openai.NewClient(openaiAPIKey)
+	// Trending Figures Endpoint, the figures with the most dialogues started
+	app.GET("/api/figures/trending", trendingHandler(cfg))
 
 	// Chat endpoint
-	app.POST("/api/chat", func(c *gin.Context) {
-		var reqBody ChatRequestBody
-		if err := c.ShouldBindJSON(&reqBody); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-			return
-		}
+	app.POST("/api/chat", rejectDuringMaintenance(), collectStats(), limitStreams(cfg), dailyBudget(cfg), chatHandler(client, cfg))
 
-		fmt.Println("Received message:", reqBody.Message)
-		fmt.Println("Mode:", reqBody.Mode)
-		fmt.Println("Figure:", reqBody.SelectedFigure)
-		fmt.Println("Topic:", reqBody.SelectedTopic)
-
-		systemPrompt := getSystemPrompt(reqBody.SelectedFigure, reqBody.Mode, reqBody.SelectedTopic)
-
-		// Convert client messages to OpenAI messages
-		var messages []openai.ChatCompletionMessage
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleSystem,
-			Content: systemPrompt,
-		})
-
-		for _, msg := range reqBody.Messages {
-			messages = append(messages, openai.ChatCompletionMessage{
-				Role:    msg.Role,
-				Content: msg.Content,
-			})
-		}
+	// Async Chat Endpoints, run a chat completion in the background and deliver it to a webhook
+	app.POST("/api/chat/async", rejectDuringMaintenance(), collectStats(), dailyBudget(cfg), asyncChatHandler(client, cfg))
+	app.GET("/api/chat/async/:id", asyncJobHandler)
 
-		// Set headers to enable SSE
-		c.Writer.Header().Set("Content-Type", "text/event-stream")
-		c.Writer.Header().Set("Cache-Control", "no-cache")
-		c.Writer.Header().Set("Connection", "keep-alive")
-		c.Writer.Flush()
+	// Start Dialogue Endpoint
+	app.POST("/api/start-dialogue", rejectDuringMaintenance(), collectStats(), limitStreams(cfg), dailyBudget(cfg), startDialogueHandler(client, cfg))
 
-		ctx := c.Request.Context()
+	// Panel Endpoint, streams a discussion between several figures taking turns
+	app.POST("/api/panel", rejectDuringMaintenance(), collectStats(), limitStreams(cfg), dailyBudget(cfg), panelHandler(client, cfg))
 
-		req := openai.ChatCompletionRequest{
-			Model:    "gpt-3.5-turbo",
-			Messages: messages,
-			Stream:   true,
-		}
+	// Conversations Endpoint, the client's conversations for a history sidebar, filterable by figure and topic
+	app.GET("/api/conversations", listConversationsHandler)
 
-		stream, err := client.CreateChatCompletionStream(ctx, req)
-		if err != nil {
-			fmt.Println("Error creating stream:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating stream"})
-			return
-		}
-		defer stream.Close()
-
-		// Handle streaming response
-		for {
-			response, err := stream.Recv()
-			if err != nil {
-				fmt.Println("Error receiving stream:", err)
-				break
-			}
-
-			if len(response.Choices) > 0 {
-				content := response.Choices[0].Delta.Content
-				if content != "" {
-					data := fmt.Sprintf("data: %s\n\n", jsonString(content))
-					c.Writer.Write([]byte(data))
-					c.Writer.Flush()
-					time.Sleep(100 * time.Millisecond) // Artificial delay
-				}
-			}
-		}
+	// Conversation Endpoint, returns a stored conversation and its locked model
+	app.GET("/api/conversations/:id", getConversationHandler)
 
-		c.Writer.Write([]byte("data: [DONE]\n\n"))
-		c.Writer.Flush()
-	})
+	// Fork Endpoint, branches a new conversation off an earlier message
+	app.POST("/api/conversations/:id/fork", forkConversationHandler(cfg))
 
-	// Start Dialogue Endpoint
-	app.POST("/api/start-dialogue", func(c *gin.Context) {
-		var reqBody StartDialogueRequestBody
-		if err := c.ShouldBindJSON(&reqBody); err != nil {
+	// Opening Questions Endpoint
+	app.POST("/api/opening-questions", openingQuestionsHandler(client, cfg))
+
+	// Abort endpoint, cancels an in-flight stream by its request ID
+	app.POST("/api/chat/abort", func(c *gin.Context) {
+		var reqBody AbortRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil || reqBody.RequestID == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 			return
 		}
 
-		fmt.Printf("Starting dialogue with %s in mode %s on topic %s\n", reqBody.Figure, reqBody.Mode, reqBody.Topic)
+		// Another client's stream is reported as not found, as if it didn't exist
+		if !inflight.cancel(reqBody.RequestID, clientID(c)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+			return
+		}
 
-		systemPrompt := getSystemPrompt(reqBody.Figure, reqBody.Mode, reqBody.Topic)
+		fmt.Println("Aborted request:", reqBody.RequestID)
+		c.JSON(http.StatusOK, gin.H{"aborted": true})
+	})
 
-		messages := []openai.ChatCompletionMessage{
-			{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: systemPrompt,
-			},
-		}
+	// OpenAI Ping Endpoint, measures the round trip of a minimal completion for diagnosing latency
+	app.GET("/api/ping-openai", requireAdmin(cfg), pingOpenAIHandler(client, cfg))
 
-		// Set headers to enable SSE
-		c.Writer.Header().Set("Content-Type", "text/event-stream")
-		c.Writer.Header().Set("Cache-Control", "no-cache")
-		c.Writer.Header().Set("Connection", "keep-alive")
-		c.Writer.Flush()
+	// Debug Replay Endpoint, shows what a chat request resolves to without calling OpenAI. Only with DEBUG set
+	if cfg.Debug {
+		app.POST("/api/debug/replay", requireAdmin(cfg), debugReplayHandler(cfg))
+	}
 
-		ctx := c.Request.Context()
+	admin := app.Group("/api/admin", requireAdmin(cfg))
 
-		req := openai.ChatCompletionRequest{
-			Model:    "gpt-3.5-turbo",
-			Messages: messages,
-			Stream:   true,
-		}
+	// Test Figure Endpoint, runs a single non-streaming completion for tuning personas
+	admin.POST("/test-figure", testFigureHandler(client, cfg))
 
-		stream, err := client.CreateChatCompletionStream(ctx, req)
-		if err != nil {
-			fmt.Println("Error creating stream:", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating stream"})
-			return
-		}
-		defer stream.Close()
-
-		// Handle streaming response
-		for {
-			response, err := stream.Recv()
-			if err != nil {
-				fmt.Println("Error receiving stream:", err)
-				break
-			}
-
-			if len(response.Choices) > 0 {
-				content := response.Choices[0].Delta.Content
-				if content != "" {
-					data := fmt.Sprintf("data: %s\n\n", jsonString(content))
-					c.Writer.Write([]byte(data))
-					c.Writer.Flush()
-					time.Sleep(100 * time.Millisecond) // Artificial delay
-				}
-			}
-		}
+	// Stats Endpoint, a snapshot of the chat and start-dialogue counters since startup
+	admin.GET("/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, stats.snapshot())
+	})
+
+	// Usage Report Endpoint, token usage and estimated cost per day, figure, mode and model as CSV
+	admin.GET("/usage.csv", usageCSVHandler(cfg))
+
+	// Maintenance Endpoints, pause and resume new chats at runtime, health endpoints stay up either way
+	admin.GET("/maintenance", func(c *gin.Context) {
+		enabled, message := maintenance.status()
+		c.JSON(http.StatusOK, gin.H{"enabled": enabled, "message": message})
+	})
+	admin.POST("/maintenance", maintenanceHandler)
 
-		c.Writer.Write([]byte("data: [DONE]\n\n"))
-		c.Writer.Flush()
+	// Config Endpoint, the effective configuration with secrets reduced to whether they are set
+	admin.GET("/config", func(c *gin.Context) {
+		c.JSON(http.StatusOK, effectiveConfig(cfg))
 	})
 
+	// Validate Config Endpoint, lints a prompts config before it is deployed, nothing is loaded
+	admin.POST("/validate-config", validateConfigHandler(cfg))
+
 	// Start the server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "4000"
-	}
-	app.Run(":" + port)
+	app.Run(":" + cfg.Port)
 
 	// Define struct for CheckAnswer request
 	type CheckAnswerRequestBody struct {
@@ -261,85 +309,21 @@ func main() {
 	})
 }
 
-func getSystemPrompt(figure string, mode string, topic ...string) string {
-	endingInstruction := `Remember, you are ` + figure + `. Speak as if you are them, impersonating their language and tone, embody them to the fullest extent. Be sure to ask the user questions and be as interactive as possible. Your goal is to foster learning and deep thinking, and be sure to relate back to topics from your works or stories from your life. If this is your first message in the dialogue, take a sentence to introduce yourself. Try to consistently relate your ideas and concepts back to the life of the individual. It is important to discuss and explain the more abstract topic itself, but making it relevant to the user is key to learning. Please keep your responses relatively brief, as this is a dialogue.`
-
-	var topicStr string
-	if len(topic) > 0 {
-		topicStr = topic[0]
-	}
-
-	switch figure {
-	case "Aristotle":
-		if mode == "socratic" {
-			return fmt.Sprintf(`You are Aristotle, the ancient Greek philosopher. Engage the user in a Socratic dialogue about "%s". Challenge their assumptions and guide them toward a refined understanding. %s`, topicStr, endingInstruction)
-		} else if mode == "teaching" {
-			return fmt.Sprintf(`You are Aristotle, teaching about "%s". Provide insightful explanations and examples. %s`, topicStr, endingInstruction)
-		}
-	case "Albert Einstein":
-		if mode == "thought_experiment" {
-			return fmt.Sprintf(`You are Albert Einstein. Engage the user in a thought experiment about "%s". Encourage deep thinking about complex concepts. %s`, topicStr, endingInstruction)
-		} else if mode == "lesson" {
-			return fmt.Sprintf(`You are Albert Einstein, teaching about "%s". Explain the theories and their implications clearly. %s`, topicStr, endingInstruction)
-		}
-	case "Leonardo da Vinci":
-		if mode == "brainstorm" {
-			return fmt.Sprintf(`You are Leonardo da Vinci. Collaborate with the user on "%s". Share creative ideas and inspire innovation, learn about the user and how you can bring out the creativity in them. %s`, topicStr, endingInstruction)
-		} else if mode == "lesson" {
-			return fmt.Sprintf(`You are Leonardo da Vinci, teaching about "%s". Provide detailed insights and techniques. %s`, topicStr, endingInstruction)
-		}
-	case "Napoleon Bonaparte":
-		if mode == "simulation" {
-			return fmt.Sprintf(`You are Napoleon Bonaparte. Engage the user in a military simulation focused on "%s". Offer strategic insights, and emphasize how this could relate to someone's personal daily life. %s`, topicStr, endingInstruction)
-		} else if mode == "lesson" {
-			return fmt.Sprintf(`You are Napoleon Bonaparte, teaching about "%s". Share leadership principles and experiences. %s`, topicStr, endingInstruction)
-		}
-	case "Cleopatra":
-		if mode == "role_play" {
-			return fmt.Sprintf(`You are Cleopatra. Engage the user in a role-playing scenario about "%s". Navigate diplomatic challenges together. %s`, topicStr, endingInstruction)
-		} else if mode == "lesson" {
-			return fmt.Sprintf(`You are Cleopatra, teaching about "%s". Share historical insights and cultural knowledge. %s`, topicStr, endingInstruction)
-		}
-	case "Confucius":
-		if mode == "discussion" {
-			return fmt.Sprintf(`You are Confucius. Engage the user in a philosophical discussion about "%s". Offer wisdom and provoke thought. %s`, topicStr, endingInstruction)
-		} else if mode == "lesson" {
-			return fmt.Sprintf(`You are Confucius, teaching about "%s". Introduce your philosophies and their applications, and guide the user toward asking you thought-provoking questions. %s`, topicStr, endingInstruction)
-		}
-	case "Charles Darwin":
-		if mode == "teaching" {
-			return fmt.Sprintf(`You are Charles Darwin, teaching about "%s". Explain the principles of evolution and natural selection, relating them to examples from your observations. %s`, topicStr, endingInstruction)
-		} else if mode == "discussion" {
-			return fmt.Sprintf(`You are Charles Darwin. Engage the user in a discussion about "%s". Encourage exploration of the natural world and consideration of the processes that drive evolution. %s`, topicStr, endingInstruction)
-		}
-	case "The Rebbe":
-		if mode == "guidance" {
-			return fmt.Sprintf(`You are Rabbi Menachem Mendel Schneerson, known as The Rebbe. Provide spiritual guidance on "%s". Offer insights based on Jewish teachings and Chassidic philosophy. %s`, topicStr, endingInstruction)
-		} else if mode == "teaching" {
-			return fmt.Sprintf(`You are The Rebbe, teaching about "%s". Share wisdom from Jewish mysticism and inspire the user to find meaning and purpose. %s`, topicStr, endingInstruction)
-		}
-	case "David Bowie":
-		if mode == "creative_discussion" {
-			return fmt.Sprintf(`You are David Bowie. Engage the user in a creative discussion about "%s". Explore themes of reinvention, creativity, and challenging norms. %s`, topicStr, endingInstruction)
-		} else if mode == "philosophy" {
-			return fmt.Sprintf(`You are David Bowie, sharing your philosophical insights on "%s". Reflect on art, identity, and the nature of change. %s`, topicStr, endingInstruction)
-		}
-	case "El Arroyo Sign":
-		if mode == "humor" {
-			return fmt.Sprintf(`You are the El Arroyo Sign, famous for witty one-liners and humorous sayings displayed daily outside the El Arroyo restaurant in Austin, Texas. Craft a funny and clever message about "%s". Use puns, sarcasm, or playful humor. Keep it short and punchy, as if it would fit on the sign.`, topicStr)
-		}
-	default:
-		if mode == "scenario" {
-			return fmt.Sprintf(`You are %s, offering advice based on your expertise and experiences. Provide thoughtful guidance to the user's situation or question. %s`, figure, endingInstruction)
-		} else {
-			return fmt.Sprintf(`You are %s. Engage in a meaningful conversation with the user. %s`, figure, endingInstruction)
-		}
-	}
-	return endingInstruction
-}
-
 // Helper function to JSON-encode a string
 func jsonString(str string) string {
-	b, _ := json.Marshal(str)
+	b, _ := jsonEncode(str)
 	return string(b)
 }
+
+// Helper function to JSON-encode a value for the event stream. Unlike json.Marshal it doesn't
+// escape <, > and &, so text like "a < b" reaches the client as written. Non-ASCII characters
+// such as emoji and CJK are written as UTF-8 either way.
+func jsonEncode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceState is whether new chats are paused, set from MAINTENANCE_MODE at startup and toggled at
+// runtime through /api/admin/maintenance
+type maintenanceState struct {
+	mu      sync.Mutex
+	enabled bool
+	message string
+}
+
+var maintenance = &maintenanceState{}
+
+// MaintenanceRequestBody represents the request body for /api/admin/maintenance
+type MaintenanceRequestBody struct {
+	Enabled *bool `json:"enabled"`
+	// Message replaces the message shown to users when set
+	Message string `json:"message,omitempty"`
+}
+
+// set turns maintenance mode on or off, an empty message keeps the current one
+func (m *maintenanceState) set(enabled bool, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enabled = enabled
+	if message != "" {
+		m.message = message
+	}
+}
+
+// status returns whether maintenance mode is on and the message shown to users
+func (m *maintenanceState) status() (bool, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.enabled, m.message
+}
+
+// rejectDuringMaintenance answers new chats with a 503 and the maintenance message while maintenance mode is on
+func rejectDuringMaintenance() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if enabled, message := maintenance.status(); enabled {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "maintenance", "message": message})
+			return
+		}
+		c.Next()
+	}
+}
+
+// maintenanceHandler handles POST /api/admin/maintenance, turning maintenance mode on or off without a redeploy
+func maintenanceHandler(c *gin.Context) {
+	var reqBody MaintenanceRequestBody
+	if err := c.ShouldBindJSON(&reqBody); err != nil || reqBody.Enabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	maintenance.set(*reqBody.Enabled, reqBody.Message)
+	enabled, message := maintenance.status()
+	fmt.Println("Maintenance mode set to", enabled)
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled, "message": message})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// collapseDuplicateMessages drops user messages that repeat the previous user message verbatim,
+// which happens when a client retries and resends the same turn
+func collapseDuplicateMessages(msgs []Message) []Message {
+	collapsed := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if n := len(collapsed); n > 0 && msg.Role == openai.ChatMessageRoleUser &&
+			collapsed[n-1].Role == openai.ChatMessageRoleUser && collapsed[n-1].Content == msg.Content {
+			continue
+		}
+		collapsed = append(collapsed, msg)
+	}
+	return collapsed
+}
+
+// allowedRoles lists ALLOWED_CLIENT_ROLES in order, for error responses
+func allowedRoles(cfg *Config) []string {
+	roles := make([]string, 0, len(cfg.AllowedClientRoles))
+	for role := range cfg.AllowedClientRoles {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// stripSystemMessages removes the system messages a client sent, returning how many were removed
+func stripSystemMessages(msgs []Message) ([]Message, int) {
+	kept := make([]Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Role != openai.ChatMessageRoleSystem {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, len(msgs) - len(kept)
+}
+
+// userTurns counts the user messages of a conversation
+func userTurns(msgs []Message) int {
+	n := 0
+	for _, msg := range msgs {
+		if msg.Role == openai.ChatMessageRoleUser {
+			n++
+		}
+	}
+	return n
+}
+
+// insertPersonaReminders adds a short system reminder after every n-th user turn, so figures
+// don't drift out of character as the original system prompt gets further away
+func insertPersonaReminders(messages []openai.ChatCompletionMessage, figure string, every int) []openai.ChatCompletionMessage {
+	if every <= 0 {
+		return messages
+	}
+
+	reminder := openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: fmt.Sprintf("Reminder: you are %s. Stay in character, speaking in their voice and from their perspective.", figure),
+	}
+
+	withReminders := make([]openai.ChatCompletionMessage, 0, len(messages)+len(messages)/every)
+	userTurns := 0
+	for _, msg := range messages {
+		withReminders = append(withReminders, msg)
+		if msg.Role != openai.ChatMessageRoleUser {
+			continue
+		}
+		if userTurns++; userTurns%every == 0 {
+			withReminders = append(withReminders, reminder)
+		}
+	}
+	return withReminders
+}
+
+// mergeMessageField folds the single message field into the conversation: messages wins when both are sent,
+// message only becomes the user turn of a request without messages. conflict reports that both were sent
+// and message isn't the last user turn of messages
+func mergeMessageField(message string, msgs []Message) (merged []Message, conflict bool) {
+	if len(msgs) == 0 {
+		if strings.TrimSpace(message) == "" {
+			return msgs, false
+		}
+		return []Message{{Role: openai.ChatMessageRoleUser, Content: message}}, false
+	}
+	conflict = strings.TrimSpace(message) != "" && strings.TrimSpace(message) != strings.TrimSpace(latestUserMessage(msgs))
+	return msgs, conflict
+}
+
+// hasUserContent reports whether the latest user turn of the conversation isn't blank. It's given the
+// merged messages, a message field that lost to messages mustn't vouch for a blank turn that's sent
+func hasUserContent(msgs []Message) bool {
+	return strings.TrimSpace(latestUserMessage(msgs)) != ""
+}
+
+// continueHistory returns a stored conversation's history followed by the client's new turn, its last user
+// message. Whatever else the client sent is ignored, so a client can't rewrite the stored transcript
+func continueHistory(stored []Message, msgs []Message) []Message {
+	history := append([]Message(nil), stored...)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == openai.ChatMessageRoleUser {
+			return append(history, msgs[i])
+		}
+	}
+	return history
+}
+
+// firstUserMessage returns the first user turn of the conversation, "" when there is none
+func firstUserMessage(msgs []Message) string {
+	for _, msg := range msgs {
+		if msg.Role == openai.ChatMessageRoleUser {
+			return msg.Content
+		}
+	}
+	return ""
+}
+
+// latestUserMessage returns the last user turn of the conversation
+func latestUserMessage(msgs []Message) string {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == openai.ChatMessageRoleUser {
+			return msgs[i].Content
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyHeader carries the client's API key, which API_KEY_MODELS maps to the models it may use
+const apiKeyHeader = "X-API-Key"
+
+// errModelNotPermitted is returned when the client's API key may not use the requested model
+var errModelNotPermitted = errors.New("model is not permitted for the API key")
+
+// errBelowMinimumModel is returned when MIN_MODEL_POLICY is "reject" and the requested model is
+// weaker than the mode's minimum
+var errBelowMinimumModel = errors.New("model is below the minimum for the mode")
+
+// resolveModel picks the requested model, then the figure's default model, then the global default,
+// raising it to the mode's minimum model when it is weaker. permitted restricts the models to those of
+// the client's API key, nil allows every model; a default the key may not use falls back to the key's first
+// model that meets the mode's minimum
+func resolveModel(cfg *Config, requested string, figure string, mode Mode, permitted []string) (string, error) {
+	model, err := pickModel(cfg, requested, figure, mode)
+	if err != nil || permitted == nil || slices.Contains(permitted, model) {
+		return model, err
+	}
+	if requested == "" {
+		for _, candidate := range permitted {
+			if meetsMinimumModel(cfg, candidate, mode) {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %q", errModelNotPermitted, model)
+}
+
+// pickModel chooses the model before the API key's restrictions apply
+func pickModel(cfg *Config, requested string, figure string, mode Mode) (string, error) {
+	if requested != "" {
+		if !cfg.AllowedModels[requested] {
+			return "", fmt.Errorf("model %q is not allowed", requested)
+		}
+		return enforceMinimumModel(cfg, requested, mode, true)
+	}
+
+	if f, ok := lookupFigure(figure); ok && f.DefaultModel != "" {
+		return enforceMinimumModel(cfg, f.DefaultModel, mode, false)
+	}
+	return enforceMinimumModel(cfg, cfg.DefaultModel, mode, false)
+}
+
+// enforceMinimumModel upgrades a model weaker than MODE_MIN_MODELS sets for the mode, ranking models by
+// their position in MODEL_TIERS. Models the client explicitly asked for are rejected instead when
+// MIN_MODEL_POLICY is "reject"
+func enforceMinimumModel(cfg *Config, model string, mode Mode, requested bool) (string, error) {
+	if meetsMinimumModel(cfg, model, mode) {
+		return model, nil
+	}
+	minimum := cfg.ModeMinModels[mode]
+	if requested && cfg.MinModelPolicy == "reject" {
+		return "", fmt.Errorf("%w: %q is below %q for %s", errBelowMinimumModel, model, minimum, mode)
+	}
+	fmt.Printf("Upgrading model %s to %s, the minimum for %s\n", model, minimum, mode)
+	return minimum, nil
+}
+
+// meetsMinimumModel reports whether a model is at least as strong as MODE_MIN_MODELS sets for the mode
+func meetsMinimumModel(cfg *Config, model string, mode Mode) bool {
+	minimum, ok := cfg.ModeMinModels[mode]
+	return !ok || modelTier(cfg, model) >= modelTier(cfg, minimum)
+}
+
+// modelTier ranks a model by MODEL_TIERS, models not listed rank lowest
+func modelTier(cfg *Config, model string) int {
+	return slices.Index(cfg.ModelTiers, model)
+}
+
+// permittedModels returns the models the request's API key may use under API_KEY_MODELS, requests
+// without a listed key get the "*" entry. nil means every allowed model
+func permittedModels(c *gin.Context, cfg *Config) []string {
+	if key := c.GetHeader(apiKeyHeader); key != "" && key != "*" {
+		if models, ok := cfg.APIKeyModels[key]; ok {
+			return models
+		}
+	}
+	return cfg.APIKeyModels["*"]
+}
+
+// respondModelError answers a request whose model resolveModel refused
+func respondModelError(c *gin.Context, err error) {
+	fmt.Println("Error resolving model:", err)
+	switch {
+	case errors.Is(err, errModelNotPermitted):
+		c.JSON(http.StatusForbidden, gin.H{"error": "model_not_permitted"})
+	case errors.Is(err, errBelowMinimumModel):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model_below_minimum"})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model not allowed"})
+	}
+}
+
+// checkFigureModels reports figures whose default model is not in the allowlist
+func checkFigureModels(cfg *Config) []string {
+	allowed := cfg.AllowedModels
+
+	var problems []string
+	for _, f := range figureCatalog {
+		if f.DefaultModel != "" && !allowed[f.DefaultModel] {
+			problems = append(problems, fmt.Sprintf("figure %q has default model %q which is not allowed", f.Name, f.DefaultModel))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFigureDefaultModel(t *testing.T) {
+	cfg := testConfig(t, "DEFAULT_MODEL", "gpt-4o-mini")
+	tests := []struct {
+		figure    string
+		requested string
+		want      string
+		err       bool
+	}{
+		{"Aristotle", "", "gpt-4o-mini", false},
+		{"David Bowie", "", "gpt-4o", false},
+		{"El Arroyo Sign", "", "gpt-4o-mini", false},
+		{"Someone Unlisted", "", "gpt-4o-mini", false},
+		// An explicit request wins over the figure's default
+		{"David Bowie", "gpt-3.5-turbo", "gpt-3.5-turbo", false},
+		{"Aristotle", "gpt-5-ultra", "", true},
+	}
+	for _, tt := range tests {
+		got, err := resolveModel(cfg, tt.requested, tt.figure, ModeSocratic, nil)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("resolveModel(%q, %q) = %q, %v, want %q", tt.requested, tt.figure, got, err, tt.want)
+		}
+	}
+}
+
+func TestFigureDefaultModelValidated(t *testing.T) {
+	if problems := checkFigureModels(testConfig(t)); len(problems) != 0 {
+		t.Errorf("problems with the default allowlist: %q", problems)
+	}
+	problems := checkFigureModels(testConfig(t, "ALLOWED_MODELS", "gpt-3.5-turbo,gpt-4o-mini", "DEFAULT_MODEL", "gpt-3.5-turbo"))
+	if len(problems) != 1 || !strings.Contains(problems[0], `"David Bowie"`) {
+		t.Errorf("problems = %q, want David Bowie's gpt-4o reported", problems)
+	}
+}
+
+func TestResolveModel(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		requested string
+		mode      Mode
+		// permitted are the API key's models, nil when it has no restrictions
+		permitted []string
+		want      string
+		err       error
+	}{
+		{"mode without minimum", "upgrade", "gpt-3.5-turbo", ModeSocratic, nil, "gpt-3.5-turbo", nil},
+		{"default upgraded", "upgrade", "", ModeGuidance, nil, "gpt-4o-mini", nil},
+		{"request upgraded", "upgrade", "gpt-3.5-turbo", ModeGuidance, nil, "gpt-4o-mini", nil},
+		{"stronger request kept", "upgrade", "gpt-4o", ModeGuidance, nil, "gpt-4o", nil},
+		{"request rejected", "reject", "gpt-3.5-turbo", ModeGuidance, nil, "", errBelowMinimumModel},
+		// Only what the client asked for is rejected, defaults are still upgraded
+		{"default upgraded under reject", "reject", "", ModeGuidance, nil, "gpt-4o-mini", nil},
+		{"default not permitted falls back", "upgrade", "", ModeSocratic, []string{"gpt-4o-mini"}, "gpt-4o-mini", nil},
+		{"request not permitted", "upgrade", "gpt-4o", ModeSocratic, []string{"gpt-3.5-turbo"}, "", errModelNotPermitted},
+		{"empty key list", "upgrade", "", ModeSocratic, []string{}, "", errModelNotPermitted},
+		// The fallback must not undercut MODE_MIN_MODELS
+		{"fallback below the mode minimum", "upgrade", "", ModeGuidance, []string{"gpt-3.5-turbo"}, "", errModelNotPermitted},
+		{"fallback skips models below the minimum", "upgrade", "", ModeGuidance, []string{"gpt-3.5-turbo", "gpt-4o"}, "gpt-4o", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "MODE_MIN_MODELS", "guidance=gpt-4o-mini", "MIN_MODEL_POLICY", tt.policy)
+			got, err := resolveModel(cfg, tt.requested, "Aristotle", tt.mode, tt.permitted)
+			if got != tt.want || !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Errorf("resolveModel = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
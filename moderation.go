@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ModerationIncident records an assistant response that the moderation endpoint flagged
+type ModerationIncident struct {
+	RequestID  string    `json:"requestId"`
+	Categories []string  `json:"categories"`
+	Time       time.Time `json:"time"`
+}
+
+// incidentLog keeps the most recent moderation incidents in memory
+type incidentLog struct {
+	mu        sync.Mutex
+	incidents []ModerationIncident
+}
+
+// maxIncidents bounds how many incidents are kept
+const maxIncidents = 100
+
+var incidents = &incidentLog{}
+
+// record adds an incident, dropping the oldest once the log is full
+func (l *incidentLog) record(incident ModerationIncident) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.incidents = append(l.incidents, incident)
+	if len(l.incidents) > maxIncidents {
+		l.incidents = l.incidents[len(l.incidents)-maxIncidents:]
+	}
+}
+
+// moderateOutput runs the assembled response through the moderation endpoint and returns
+// the flagged categories, which are empty when the response is fine
+func moderateOutput(ctx context.Context, client ChatClient, content string) ([]string, error) {
+	resp, err := client.Moderations(ctx, openai.ModerationRequest{Input: content})
+	if err != nil {
+		return nil, err
+	}
+
+	var flagged []string
+	for _, result := range resp.Results {
+		if !result.Flagged {
+			continue
+		}
+
+		// Category names come from the JSON tags, e.g. "self-harm/intent"
+		var categories map[string]bool
+		b, _ := json.Marshal(result.Categories)
+		json.Unmarshal(b, &categories)
+		for category, hit := range categories {
+			if hit {
+				flagged = append(flagged, category)
+			}
+		}
+		if len(flagged) == 0 {
+			flagged = append(flagged, "unspecified")
+		}
+	}
+	sort.Strings(flagged)
+	return flagged, nil
+}
+
+// reviewReply applies to a complete reply what streaming applies as it goes: a reply matching STOP_PATTERNS
+// is withheld, KID_SAFE_MODE words are redacted and the result is moderated. It returns the reply to send,
+// empty when blocked, and whether the client should be warned it was flagged
+func reviewReply(ctx context.Context, cfg *Config, client ChatClient, requestID string, content string) (reply string, blocked bool, flagged bool) {
+	if rule := bannedTopic(cfg.StopPatterns, content); rule != "" {
+		fmt.Printf("Output matched stop pattern %q, blocking reply for request %s\n", rule, requestID)
+		return "", true, false
+	}
+	if cfg.KidSafeMode {
+		content = newProfanityFilter(cfg.KidSafeWords).redact(content)
+	}
+	return content, false, checkOutput(ctx, cfg, client, requestID, content)
+}
+
+// checkOutput moderates a finished response when ENABLE_OUTPUT_MODERATION is set, recording an incident
+// when it is flagged and reporting whether the client should be warned
+func checkOutput(ctx context.Context, cfg *Config, client ChatClient, requestID string, content string) bool {
+	if !cfg.EnableOutputModeration || content == "" {
+		return false
+	}
+
+	categories, err := moderateOutput(ctx, client, content)
+	if err != nil {
+		fmt.Println("Error moderating output:", err)
+		return false
+	}
+	if len(categories) == 0 {
+		return false
+	}
+
+	fmt.Printf("Output flagged by moderation for request %s: %v\n", requestID, categories)
+	incidents.record(ModerationIncident{RequestID: requestID, Categories: categories, Time: time.Now()})
+	return cfg.OutputFlaggedEvent
+}
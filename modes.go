@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Mode is the style of dialogue a figure is engaged in
+type Mode string
+
+const (
+	ModeSocratic           Mode = "socratic"
+	ModeTeaching           Mode = "teaching"
+	ModeThoughtExperiment  Mode = "thought_experiment"
+	ModeLesson             Mode = "lesson"
+	ModeBrainstorm         Mode = "brainstorm"
+	ModeSimulation         Mode = "simulation"
+	ModeRolePlay           Mode = "role_play"
+	ModeDiscussion         Mode = "discussion"
+	ModeGuidance           Mode = "guidance"
+	ModeCreativeDiscussion Mode = "creative_discussion"
+	ModePhilosophy         Mode = "philosophy"
+	ModeHumor              Mode = "humor"
+	ModeScenario           Mode = "scenario"
+)
+
+// modes is the set of valid modes
+var modes = map[Mode]bool{
+	ModeSocratic:           true,
+	ModeTeaching:           true,
+	ModeThoughtExperiment:  true,
+	ModeLesson:             true,
+	ModeBrainstorm:         true,
+	ModeSimulation:         true,
+	ModeRolePlay:           true,
+	ModeDiscussion:         true,
+	ModeGuidance:           true,
+	ModeCreativeDiscussion: true,
+	ModePhilosophy:         true,
+	ModeHumor:              true,
+	ModeScenario:           true,
+}
+
+// Validate checks that the mode is empty or one of the defined modes
+func (m Mode) Validate() error {
+	if m != "" && !modes[m] {
+		return fmt.Errorf("unknown mode %q", string(m))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxMessageNameLength is the longest message name OpenAI accepts
+const maxMessageNameLength = 64
+
+// messageNames maps participant names to message names OpenAI accepts (^[a-zA-Z0-9_-]+$), so
+// "Albert Einstein" is sent as "Albert_Einstein". Names that slugify alike get a numbered suffix
+type messageNames struct {
+	slugs map[string]string
+	// display maps each slug back to its name for the client
+	display map[string]string
+}
+
+func newMessageNames() *messageNames {
+	return &messageNames{slugs: make(map[string]string), display: make(map[string]string)}
+}
+
+// slug returns the message name for a participant, the same one every time it is asked
+func (n *messageNames) slug(name string) string {
+	if slug, ok := n.slugs[name]; ok {
+		return slug
+	}
+
+	base := slugifyName(name)
+	slug := base
+	for i := 2; n.display[slug] != ""; i++ {
+		suffix := fmt.Sprintf("_%d", i)
+		slug = base[:min(len(base), maxMessageNameLength-len(suffix))] + suffix
+	}
+	n.slugs[name] = slug
+	n.display[slug] = name
+	return slug
+}
+
+// latinLetters spells out the letters that have no decomposed form to strip an accent from
+var latinLetters = strings.NewReplacer("ø", "o", "Ø", "O", "ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "þ", "th", "Þ", "Th")
+
+// slugifyName strips accents, turns runs of other characters into an underscore and caps the length
+func slugifyName(name string) string {
+	var b strings.Builder
+	gap := false
+	for _, r := range norm.NFD.String(latinLetters.Replace(name)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// The accent of a decomposed letter, the letter itself is kept
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'):
+			if gap && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			gap = false
+			b.WriteRune(r)
+		default:
+			gap = true
+		}
+	}
+
+	slug := b.String()
+	if len(slug) > maxMessageNameLength {
+		slug = slug[:maxMessageNameLength]
+	}
+	if slug == "" {
+		return "participant"
+	}
+	return slug
+}
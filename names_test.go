@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugifyName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Aristotle", "Aristotle"},
+		{"Albert Einstein", "Albert_Einstein"},
+		{"  Leonardo   da Vinci ", "Leonardo_da_Vinci"},
+		{"Frédéric Chopin", "Frederic_Chopin"},
+		{"Søren Kierkegaard", "Soren_Kierkegaard"},
+		{"Émilie du Châtelet", "Emilie_du_Chatelet"},
+		{"Carl Friedrich Gauß", "Carl_Friedrich_Gauss"},
+		{"Martin Luther King, Jr.", "Martin_Luther_King_Jr"},
+		{"Jean-Paul Sartre", "Jean-Paul_Sartre"},
+		{"孔子", "participant"},
+		{"", "participant"},
+		{strings.Repeat("a", 70), strings.Repeat("a", maxMessageNameLength)},
+	}
+	for _, tt := range tests {
+		if got := slugifyName(tt.name); got != tt.want {
+			t.Errorf("slugifyName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMessageNames(t *testing.T) {
+	names := newMessageNames()
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Albert Einstein", "Albert_Einstein"},
+		{"Albert Einstein", "Albert_Einstein"},
+		{"Albert-Einstein", "Albert-Einstein"},
+		{"Albert  Einstein", "Albert_Einstein_2"},
+		{"Albért Einstein", "Albert_Einstein_3"},
+		{"孔子", "participant"},
+		{"老子", "participant_2"},
+		{strings.Repeat("a", 70), strings.Repeat("a", maxMessageNameLength)},
+		{strings.Repeat("a", 65), strings.Repeat("a", maxMessageNameLength-2) + "_2"},
+	}
+	for _, tt := range tests {
+		if got := names.slug(tt.name); got != tt.want {
+			t.Errorf("slug(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := names.display[tt.want]; got != tt.name {
+			t.Errorf("display[%q] = %q, want %q", tt.want, got, tt.name)
+		}
+	}
+}
+
+func TestChatMessageNames(t *testing.T) {
+	cfg := testConfig(t)
+	client := &fakeChatClient{deltas: []string{"Hello."}}
+	w := serve(chatHandler(client, cfg), `{"messages":[{"role":"user","name":"Søren Kierkegaard","content":"Hi"},{"role":"user","name":"孔子","content":"Hello"}],"mode":"socratic","selectedFigure":"Aristotle"}`)
+
+	messages := client.lastRequest(t).Messages
+	if got := []string{messages[len(messages)-2].Name, messages[len(messages)-1].Name}; got[0] != "Soren_Kierkegaard" || got[1] != "participant" {
+		t.Errorf("upstream message names = %q", got)
+	}
+
+	events := sseEvents(t, w.Body.String())
+	meta, _ := events[0].(map[string]any)
+	names, _ := meta["names"].(map[string]any)
+	if names["Soren_Kierkegaard"] != "Søren Kierkegaard" || names["participant"] != "孔子" {
+		t.Errorf("meta event names = %v", meta["names"])
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// PanelRequestBody represents the request body for /api/panel
+type PanelRequestBody struct {
+	Figures []string `json:"figures"`
+	Topic   string   `json:"topic"`
+	Mode    Mode     `json:"mode"`
+	// Rounds is how many times every figure speaks, defaults to 1
+	Rounds int    `json:"rounds,omitempty"`
+	Model  string `json:"model,omitempty"`
+}
+
+// PanelEvent is the first SSE event of a panel discussion
+type PanelEvent struct {
+	Type    string   `json:"type"`
+	Figures []string `json:"figures"`
+	Topic   string   `json:"topic"`
+	Rounds  int      `json:"rounds"`
+	// Names maps the message names the panelists are sent under to their display names
+	Names map[string]string `json:"names"`
+}
+
+// PanelTurnEvent announces the figure whose contribution the following deltas belong to
+type PanelTurnEvent struct {
+	Type   string `json:"type"`
+	Figure string `json:"figure"`
+	Round  int    `json:"round"`
+}
+
+// panelTurn is one contribution to a panel discussion
+type panelTurn struct {
+	figure  string
+	content string
+}
+
+// panelStream is a panelist's opened completion
+type panelStream struct {
+	req    openai.ChatCompletionRequest
+	stream ChatStream
+	// connect is how long opening the stream took, connected is when it was open
+	connect   time.Duration
+	connected time.Time
+}
+
+// panelHandler handles /api/panel, streaming a discussion where the figures take turns on a topic,
+// each seeing what was said before. A turn event precedes each figure's deltas
+func panelHandler(client ChatClient, cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqBody PanelRequestBody
+		if err := c.ShouldBindJSON(&reqBody); err != nil || strings.TrimSpace(reqBody.Topic) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		tagRequest(c, "", reqBody.Mode)
+
+		// A figure named twice, in any spelling, takes a single seat
+		reqBody.Figures = uniqueFigures(reqBody.Figures)
+		if len(reqBody.Figures) < 2 || len(reqBody.Figures) > cfg.MaxPanelFigures {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A panel needs between 2 and %d figures", cfg.MaxPanelFigures)})
+			return
+		}
+
+		if reqBody.Rounds == 0 {
+			reqBody.Rounds = 1
+		}
+		if reqBody.Rounds < 0 || reqBody.Rounds > cfg.MaxPanelRounds {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rounds count"})
+			return
+		}
+
+		if err := reqBody.Mode.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mode"})
+			return
+		}
+
+		if rule := bannedTopic(cfg.BannedTopics, reqBody.Topic); rule != "" {
+			fmt.Printf("Blocked banned topic %q for request %s\n", rule, c.GetString("requestID"))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "topic_not_allowed"})
+			return
+		}
+
+		for _, figure := range reqBody.Figures {
+			if figure == "" || !figureAvailable(cfg, figure) {
+				respondUnknownFigure(c, cfg, figure)
+				return
+			}
+			if !modeSupported(figure, reqBody.Mode) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "mode_not_supported"})
+				return
+			}
+			if !allowCustomFigure(c, cfg, figure) {
+				return
+			}
+		}
+
+		// Resolve every figure's request up front so a bad model fails before the stream starts
+		requests := make(map[string]openai.ChatCompletionRequest)
+		for _, figure := range reqBody.Figures {
+			params, err := resolveParams("", figure, ModelParams{})
+			if err != nil {
+				fmt.Println("Error resolving parameters:", err)
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid profile"})
+				return
+			}
+			model, err := resolveModel(cfg, reqBody.Model, figure, reqBody.Mode, permittedModels(c, cfg))
+			if err != nil {
+				respondModelError(c, err)
+				return
+			}
+
+			req := openai.ChatCompletionRequest{Model: model, Stream: true, MaxTokens: cfg.PanelTurnMaxTokens}
+			params.apply(&req)
+			if includeUsage(cfg) {
+				req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+			}
+			requests[figure] = req
+		}
+
+		fmt.Printf("Starting panel with %s on topic %s (%d rounds)\n", strings.Join(reqBody.Figures, ", "), reqBody.Topic, reqBody.Rounds)
+
+		// The duration cap covers the whole panel, not each turn
+		ctx, cancel := withStreamDeadline(c.Request.Context(), cfg)
+		defer cancel()
+
+		// The whole panel can be aborted through /api/chat/abort
+		id := c.GetString("requestID")
+		inflight.add(id, clientID(c), cancel)
+		defer inflight.remove(id)
+
+		names := newMessageNames()
+		for _, figure := range reqBody.Figures {
+			names.slug(figure)
+		}
+
+		var transcript []panelTurn
+		openTurn := func(figure string) (panelStream, error) {
+			req := requests[figure]
+			req.Messages = panelMessages(cfg, figure, reqBody, transcript, names)
+			connectStart := time.Now()
+			stream, err := client.CreateChatCompletionStream(ctx, req)
+			connected := time.Now()
+			return panelStream{req: req, stream: stream, connect: connected.Sub(connectStart), connected: connected}, err
+		}
+
+		// The first turn is opened before the event stream starts, so a failure is still answered with its own status
+		turn, err := openTurn(reqBody.Figures[0])
+		if err != nil {
+			fmt.Println("Error creating panel stream:", err)
+			respondStreamError(c, ctx, err)
+			return
+		}
+
+		defer startSSE(c, cfg)()
+		writeEvent(c, PanelEvent{Type: "panel", Figures: reqBody.Figures, Topic: reqBody.Topic, Rounds: reqBody.Rounds, Names: names.display})
+
+	discussion:
+		for round := 1; round <= reqBody.Rounds; round++ {
+			for i, figure := range reqBody.Figures {
+				if round > 1 || i > 0 {
+					if turn, err = openTurn(figure); err != nil {
+						fmt.Println("Error creating panel stream:", err)
+						if streamExpired(ctx) {
+							stats.recordStreamEnd(streamTimedOut, 0)
+							writeEvent(c, gin.H{"type": "timeout"})
+						} else {
+							writeEvent(c, upstreamErrorEvent(err))
+						}
+						break discussion
+					}
+				}
+
+				writeEvent(c, PanelTurnEvent{Type: "turn", Figure: figure, Round: round})
+				result := streamUsage(cfg, turn.req, relayStream(ctx, c, cfg, turn.stream, id))
+				turn.stream.Close()
+				logCompletionTiming(id, turn.req.Model, turn.connect, turn.connected, result)
+				recordTokenUsage(c, cfg, figure, turn.req.Model, result.usage)
+
+				if result.end == streamDisconnected {
+					return
+				}
+				if result.end != streamComplete {
+					if result.end == streamFailed {
+						c.Set("streamFailed", true)
+						writeInterrupted(c, cfg, result)
+					}
+					break discussion
+				}
+				transcript = append(transcript, panelTurn{figure: figure, content: result.content})
+			}
+		}
+
+		c.Writer.Write([]byte("data: [DONE]\n\n"))
+		c.Writer.Flush()
+	}
+}
+
+// uniqueFigures returns the catalog spelling of each figure, dropping the ones already named in another case
+func uniqueFigures(figures []string) []string {
+	unique := make([]string, 0, len(figures))
+	seen := make(map[string]bool)
+	for _, figure := range figures {
+		figure = canonicalFigure(figure)
+		if key := strings.ToLower(figure); !seen[key] {
+			seen[key] = true
+			unique = append(unique, figure)
+		}
+	}
+	return unique
+}
+
+// panelMessages builds a panelist's view of the discussion: its persona prompt with the panel setting,
+// its own earlier turns as assistant messages and everyone else's as user messages labeled and named after the speaker
+func panelMessages(cfg *Config, figure string, reqBody PanelRequestBody, transcript []panelTurn, names *messageNames) []openai.ChatCompletionMessage {
+	var others []string
+	for _, f := range reqBody.Figures {
+		if f != figure {
+			others = append(others, f)
+		}
+	}
+
+	prompt := getSystemPrompt(cfg, figure, reqBody.Mode, reqBody.Topic, promptOptions{concise: true, personalize: true})
+	prompt.add("panel", fmt.Sprintf(` You are taking part in a panel discussion with %s on "%s". Respond to the other panelists' points and add your own perspective, speaking only as yourself. Keep your contribution to a short paragraph.`, strings.Join(others, " and "), reqBody.Topic), priorityPersona)
+
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: prompt.render(cfg.MaxSystemPromptChars)},
+	}
+	if len(transcript) == 0 {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: fmt.Sprintf(`Please open the panel discussion on "%s".`, reqBody.Topic),
+		})
+	}
+	for _, turn := range transcript {
+		if turn.figure == figure {
+			messages = append(messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: turn.content})
+			continue
+		}
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleUser,
+			Content: turn.figure + ": " + turn.content,
+			Name:    names.slug(turn.figure),
+		})
+	}
+	return messages
+}
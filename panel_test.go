@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestUniqueFigures(t *testing.T) {
+	tests := []struct {
+		figures []string
+		want    []string
+	}{
+		{[]string{"Aristotle", "Confucius"}, []string{"Aristotle", "Confucius"}},
+		{[]string{"Aristotle", "aristotle"}, []string{"Aristotle"}},
+		{[]string{" ARISTOTLE ", "Confucius", "aristotle"}, []string{"Aristotle", "Confucius"}},
+	}
+	for _, tt := range tests {
+		if got := uniqueFigures(tt.figures); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("uniqueFigures(%q) = %q, want %q", tt.figures, got, tt.want)
+		}
+	}
+}
+
+func TestPanelHandler(t *testing.T) {
+	quota := &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Code: "insufficient_quota", Message: "You exceeded your current quota"}
+	limited := &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "Please try again in 1s"}
+	tests := []struct {
+		name     string
+		body     string
+		streams  [][]string
+		err      error
+		status   int
+		events   []string
+		requests int
+		// errorEvent is expected in the stream when a later turn fails
+		errorEvent string
+	}{
+		{"takes turns", `{"figures":["Aristotle","Confucius"],"topic":"virtue","rounds":2}`, nil, nil, http.StatusOK, []string{"panel", "turn", "turn", "turn", "turn"}, 4, ""},
+		// The same figure twice isn't a panel, and a figure named twice takes one seat
+		{"duplicate figure", `{"figures":["Aristotle","aristotle"],"topic":"virtue"}`, nil, nil, http.StatusBadRequest, nil, 0, ""},
+		{"duplicate seat", `{"figures":["Aristotle","aristotle","Confucius"],"topic":"virtue"}`, nil, nil, http.StatusOK, []string{"panel", "turn", "turn"}, 2, ""},
+		// Once the event stream has started, a failed turn ends the discussion with an error event
+		{"later turn fails", `{"figures":["Aristotle","Confucius"],"topic":"virtue"}`, [][]string{{"Virtue is a habit."}}, quota, http.StatusOK, []string{"panel", "turn", "error"}, 2, `{"type":"error","error":"service_unavailable"}`},
+		{"later turn rate limited", `{"figures":["Aristotle","Confucius"],"topic":"virtue"}`, [][]string{{"Virtue is a habit."}}, limited, http.StatusOK, []string{"panel", "turn", "error"}, 2, `{"type":"error","error":"upstream_rate_limited","retryAfter":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			client := &fakeChatClient{deltas: []string{"Virtue is a habit."}, streams: tt.streams, err: tt.err}
+			w := serve(panelHandler(client, cfg), tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if len(client.requests) != tt.requests {
+				t.Errorf("%d turns, want %d", len(client.requests), tt.requests)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if types, _ := eventTypes(sseEvents(t, w.Body.String())); !reflect.DeepEqual(types, tt.events) {
+				t.Errorf("events = %v, want %v", types, tt.events)
+			}
+			if tt.errorEvent != "" && (!strings.Contains(w.Body.String(), "data: "+tt.errorEvent+"\n") || strings.Contains(w.Body.String(), "event:")) {
+				t.Errorf("want the plain error event %s:\n%s", tt.errorEvent, w.Body)
+			}
+		})
+	}
+}
+
+func TestPanelTranscript(t *testing.T) {
+	cfg := testConfig(t)
+	client := &fakeChatClient{deltas: []string{"Virtue is a habit."}}
+	serve(panelHandler(client, cfg), `{"figures":["Aristotle","Confucius"],"topic":"virtue","rounds":2}`)
+
+	// Confucius hears Aristotle's turn, labeled with his name
+	messages := client.requests[1].Messages
+	if last := messages[len(messages)-1]; last.Role != openai.ChatMessageRoleUser || last.Content != "Aristotle: Virtue is a habit." {
+		t.Errorf("second turn ends with %+v, want Aristotle's turn", last)
+	}
+	// Aristotle's own earlier turn comes back to him as his reply
+	for _, msg := range client.requests[2].Messages {
+		if msg.Role == openai.ChatMessageRoleAssistant && msg.Content == "Virtue is a habit." {
+			return
+		}
+	}
+	t.Error("Aristotle's second turn doesn't include his first as an assistant message")
+}
+
+func TestPanelChargesEveryTurn(t *testing.T) {
+	cfg := testConfig(t, "DAILY_TOKEN_BUDGET", "100000")
+	client := &fakeChatClient{deltas: []string{"Virtue is a habit."}, usage: &openai.Usage{PromptTokens: 30, CompletionTokens: 10, TotalTokens: 40}}
+
+	var tokens int
+	app := gin.New()
+	app.POST("/", requestID(), func(c *gin.Context) {
+		c.Next()
+		tokens = c.GetInt("tokens")
+	}, panelHandler(client, cfg))
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"figures":["Aristotle","Confucius"],"topic":"virtue","rounds":2}`))
+	r.RemoteAddr = "192.0.2.30:1234"
+	app.ServeHTTP(httptest.NewRecorder(), r)
+
+	if tokens != 160 {
+		t.Errorf("request stats got %d tokens, want the 160 of all four turns", tokens)
+	}
+	if spent := dailyTokens.spent("192.0.2.30"); spent != 160 {
+		t.Errorf("budget charged %d tokens, want 160", spent)
+	}
+}
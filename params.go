@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ModelParams holds the sampling parameters sent to the model, nil fields use the model defaults
+type ModelParams struct {
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TopP             *float32 `json:"topP,omitempty"`
+	PresencePenalty  *float32 `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequencyPenalty,omitempty"`
+}
+
+// modelProfiles are the named parameter sets a client can select with "profile"
+var modelProfiles = map[string]ModelParams{
+	"precise": {
+		Temperature:      float32Ptr(0.2),
+		TopP:             float32Ptr(0.9),
+		PresencePenalty:  float32Ptr(0),
+		FrequencyPenalty: float32Ptr(0),
+	},
+	"balanced": {
+		Temperature:      float32Ptr(0.7),
+		TopP:             float32Ptr(1),
+		PresencePenalty:  float32Ptr(0.2),
+		FrequencyPenalty: float32Ptr(0.2),
+	},
+	"creative": {
+		Temperature:      float32Ptr(1.1),
+		TopP:             float32Ptr(1),
+		PresencePenalty:  float32Ptr(0.6),
+		FrequencyPenalty: float32Ptr(0.4),
+	},
+}
+
+// resolveParams expands the requested (or figure default) profile and applies explicit parameters on top
+func resolveParams(profile string, figure string, explicit ModelParams) (ModelParams, error) {
+	if profile == "" {
+		if f, ok := lookupFigure(figure); ok {
+			profile = f.Profile
+		}
+	}
+
+	var params ModelParams
+	if profile != "" {
+		p, ok := modelProfiles[profile]
+		if !ok {
+			return params, fmt.Errorf("unknown profile %q", profile)
+		}
+		params = p
+	}
+
+	if explicit.Temperature != nil {
+		params.Temperature = explicit.Temperature
+	}
+	if explicit.TopP != nil {
+		params.TopP = explicit.TopP
+	}
+	if explicit.PresencePenalty != nil {
+		params.PresencePenalty = explicit.PresencePenalty
+	}
+	if explicit.FrequencyPenalty != nil {
+		params.FrequencyPenalty = explicit.FrequencyPenalty
+	}
+	return params, nil
+}
+
+// apply copies the parameters onto an OpenAI request
+func (p ModelParams) apply(req *openai.ChatCompletionRequest) {
+	if p.Temperature != nil {
+		req.Temperature = *p.Temperature
+		if req.Temperature == 0 {
+			// go-openai omits a zero temperature, so send the smallest non-zero value instead
+			req.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if p.TopP != nil {
+		req.TopP = *p.TopP
+	}
+	if p.PresencePenalty != nil {
+		req.PresencePenalty = *p.PresencePenalty
+	}
+	if p.FrequencyPenalty != nil {
+		req.FrequencyPenalty = *p.FrequencyPenalty
+	}
+}
+
+// applyMaxTokens caps the response length at the client's max_tokens when given, otherwise at the figure's
+// max_tokens for the mode or its response token budget. The budget is a ceiling none of them may exceed
+func applyMaxTokens(req *openai.ChatCompletionRequest, figure string, mode Mode, requested int) {
+	if config, ok := lookupModeConfig(figure, mode); ok && config.MaxTokens > 0 {
+		req.MaxTokens = config.MaxTokens
+	}
+	if requested > 0 {
+		req.MaxTokens = requested
+	}
+
+	f, ok := lookupFigure(figure)
+	if !ok || f.ResponseTokenBudget == 0 {
+		return
+	}
+	if req.MaxTokens == 0 || req.MaxTokens > f.ResponseTokenBudget {
+		req.MaxTokens = f.ResponseTokenBudget
+	}
+}
+
+// TemperatureSchedule lowers the temperature linearly from Start on the first user turn to End at Turns
+// user turns, staying at End afterwards
+type TemperatureSchedule struct {
+	Start float32 `json:"start"`
+	End   float32 `json:"end"`
+	Turns int     `json:"turns"`
+}
+
+// at returns the scheduled temperature for the n-th user turn, counting from 1, bounded to the valid 0-2 range
+func (s TemperatureSchedule) at(turn int) float32 {
+	t := s.End
+	if s.Turns > 1 && turn < s.Turns {
+		progress := float32(max(turn-1, 0)) / float32(s.Turns-1)
+		t = s.Start + (s.End-s.Start)*progress
+	}
+	return min(max(t, 0), 2)
+}
+
+// scheduleTemperature sets the temperature from the figure's schedule for the mode when TEMPERATURE_SCHEDULES
+// is on, unless the client or a profile chose a temperature
+func scheduleTemperature(cfg *Config, params ModelParams, figure string, mode Mode, userTurns int) ModelParams {
+	if !cfg.TemperatureSchedules || params.Temperature != nil {
+		return params
+	}
+	config, ok := lookupModeConfig(figure, mode)
+	if !ok || config.TemperatureSchedule == nil {
+		return params
+	}
+	params.Temperature = float32Ptr(config.TemperatureSchedule.at(userTurns))
+	return params
+}
+
+// Helper function to take the address of a float32 literal
+func float32Ptr(f float32) *float32 {
+	return &f
+}
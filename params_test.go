@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestTemperatureScheduleAt(t *testing.T) {
+	cooling := TemperatureSchedule{Start: 1.0, End: 0.5, Turns: 11}
+	tests := []struct {
+		schedule TemperatureSchedule
+		turn     int
+		want     float32
+	}{
+		{cooling, 0, 1.0},
+		{cooling, 1, 1.0},
+		{cooling, 2, 0.95},
+		{cooling, 6, 0.75},
+		{cooling, 11, 0.5},
+		{cooling, 50, 0.5},
+		{TemperatureSchedule{Start: 0.2, End: 1.2, Turns: 3}, 2, 0.7},
+		{TemperatureSchedule{Start: 0.8, End: 0.3, Turns: 1}, 1, 0.3},
+		// Bounded to the valid range
+		{TemperatureSchedule{Start: 3, End: 2.5, Turns: 5}, 1, 2},
+		{TemperatureSchedule{Start: 0.5, End: -1, Turns: 5}, 5, 0},
+	}
+	for _, tt := range tests {
+		got := tt.schedule.at(tt.turn)
+		if diff := got - tt.want; diff > 0.0001 || diff < -0.0001 {
+			t.Errorf("%+v.at(%d) = %v, want %v", tt.schedule, tt.turn, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleTemperature(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    []string
+		params ModelParams
+		figure string
+		mode   Mode
+		turns  int
+		want   *float32
+	}{
+		{"schedules off", nil, ModelParams{}, "Aristotle", ModeSocratic, 5, nil},
+		{"first turn", []string{"TEMPERATURE_SCHEDULES", "true"}, ModelParams{}, "Aristotle", ModeSocratic, 1, float32Ptr(1.0)},
+		{"later turn", []string{"TEMPERATURE_SCHEDULES", "true"}, ModelParams{}, "Aristotle", ModeSocratic, 10, float32Ptr(0.5)},
+		{"chosen temperature", []string{"TEMPERATURE_SCHEDULES", "true"}, ModelParams{Temperature: float32Ptr(0.2)}, "Aristotle", ModeSocratic, 1, float32Ptr(0.2)},
+		{"mode without schedule", []string{"TEMPERATURE_SCHEDULES", "true"}, ModelParams{}, "Aristotle", ModeTeaching, 1, nil},
+		{"figure outside the catalog", []string{"TEMPERATURE_SCHEDULES", "true"}, ModelParams{}, "Hypatia", ModeSocratic, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scheduleTemperature(testConfig(t, tt.env...), tt.params, tt.figure, tt.mode, tt.turns).Temperature
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("temperature = %v, want %v", ptrString(got), ptrString(tt.want))
+			}
+		})
+	}
+}
+
+// ptrString formats an optional temperature for test failures
+func ptrString(f *float32) string {
+	if f == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*f)
+}
+
+func TestChatTemperatureSchedule(t *testing.T) {
+	cfg := testConfig(t, "TEMPERATURE_SCHEDULES", "true")
+	turns := `[{"role":"user","content":"Hi"}]`
+	var temperatures []float32
+	for i := 0; i < 3; i++ {
+		client := &fakeChatClient{deltas: []string{"Hello."}}
+		serve(chatHandler(client, cfg), `{"messages":`+turns+`,"mode":"socratic","selectedFigure":"Aristotle"}`)
+		temperatures = append(temperatures, client.lastRequest(t).Temperature)
+		turns = turns[:len(turns)-1] + `,{"role":"assistant","content":"Hello."},{"role":"user","content":"Go on"}]`
+	}
+	if !(temperatures[0] > temperatures[1] && temperatures[1] > temperatures[2]) {
+		t.Errorf("temperatures over the dialogue = %v, want them decreasing", temperatures)
+	}
+}
+
+func TestApplyMaxTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		figure    string
+		mode      Mode
+		requested int
+		want      int
+	}{
+		{"mode limit", "Aristotle", ModeSocratic, 0, 200},
+		{"requested over the mode limit", "Aristotle", ModeSocratic, 500, 500},
+		{"no limit", "David Bowie", ModePhilosophy, 0, 0},
+		{"budget without a mode limit", "El Arroyo Sign", ModeHumor, 0, 60},
+		{"requested within the budget", "El Arroyo Sign", ModeHumor, 40, 40},
+		{"requested over the budget", "El Arroyo Sign", ModeHumor, 500, 60},
+		{"figure outside the catalog", "Hypatia", ModeSocratic, 300, 300},
+	}
+	for _, tt := range tests {
+		req := openai.ChatCompletionRequest{}
+		applyMaxTokens(&req, tt.figure, tt.mode, tt.requested)
+		if req.MaxTokens != tt.want {
+			t.Errorf("%s: max_tokens = %d, want %d", tt.name, req.MaxTokens, tt.want)
+		}
+	}
+}
+
+func TestChatMaxTokensWithinBudget(t *testing.T) {
+	cfg := testConfig(t, "GREETING_MAX_TOKENS", "500")
+	tests := []struct {
+		name    string
+		handler func(ChatClient, *Config) gin.HandlerFunc
+		body    string
+		status  int
+		want    int
+	}{
+		{"chat", chatHandler, `{"message":"Hi","mode":"humor","selectedFigure":"El Arroyo Sign"}`, http.StatusOK, 60},
+		{"chat override", chatHandler, `{"message":"Hi","mode":"humor","selectedFigure":"El Arroyo Sign","maxTokens":30}`, http.StatusOK, 30},
+		{"chat override over budget", chatHandler, `{"message":"Hi","mode":"humor","selectedFigure":"El Arroyo Sign","maxTokens":4000}`, http.StatusOK, 60},
+		{"greeting over budget", startDialogueHandler, `{"figure":"El Arroyo Sign","mode":"humor","topic":"heat"}`, http.StatusOK, 60},
+		{"greeting without budget", startDialogueHandler, `{"figure":"Aristotle","mode":"socratic","topic":"virtue"}`, http.StatusOK, 500},
+	}
+	for _, tt := range tests {
+		client := &fakeChatClient{deltas: []string{"Hello."}}
+		w := serve(tt.handler(client, cfg), tt.body)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if got := client.lastRequest(t).MaxTokens; got != tt.want {
+			t.Errorf("%s: max_tokens = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// pingOpenAIHandler handles /api/ping-openai, timing a minimal 1-token completion so slowness can be
+// told apart from OpenAI's side. ?model= picks an allowed model, the default model otherwise
+func pingOpenAIHandler(client ChatClient, cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		model := c.DefaultQuery("model", cfg.DefaultModel)
+		if !cfg.AllowedModels[model] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Model not allowed"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), cfg.PingTimeout)
+		defer cancel()
+
+		start := time.Now()
+		_, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+			Model:     model,
+			Messages:  []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ping"}},
+			MaxTokens: 1,
+		})
+		elapsed := time.Since(start)
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			fmt.Printf("OpenAI ping timed out after %s\n", cfg.PingTimeout)
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": "timeout", "model": model, "timeoutMs": cfg.PingTimeout.Milliseconds()})
+			return
+		}
+		if err != nil {
+			fmt.Println("Error pinging OpenAI:", err)
+			respondUpstreamError(c, err, "Error pinging OpenAI")
+			return
+		}
+
+		fmt.Printf("OpenAI ping with %s took %s\n", model, elapsed.Round(time.Millisecond))
+		c.JSON(http.StatusOK, gin.H{"model": model, "latencyMs": elapsed.Milliseconds()})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// promptOptions toggles the optional fragments of the ending instruction
+type promptOptions struct {
+	// interactive asks the figure to question the user and keep the dialogue interactive
+	interactive bool
+	// concise asks the figure to keep its responses brief
+	concise bool
+	// greeting is set for prompts that get the start-dialogue greeting instruction, which replaces
+	// the generic request to introduce yourself in the first message
+	greeting bool
+	// personalize asks the figure to relate its ideas to the user's own life, off for quick factual answers
+	personalize bool
+}
+
+// InstructionFlags are the request fields that toggle parts of the ending instruction, all default to true
+type InstructionFlags struct {
+	Interactive *bool `json:"interactive,omitempty"`
+	Concise     *bool `json:"concise,omitempty"`
+	Personalize *bool `json:"personalize,omitempty"`
+}
+
+// promptOptions resolves the flags to prompt options, unset flags keep the default behaviour
+func (f InstructionFlags) promptOptions() promptOptions {
+	opts := promptOptions{interactive: true, concise: true, personalize: true}
+	if f.Interactive != nil {
+		opts.interactive = *f.Interactive
+	}
+	if f.Concise != nil {
+		opts.concise = *f.Concise
+	}
+	if f.Personalize != nil {
+		opts.personalize = *f.Personalize
+	}
+	return opts
+}
+
+// getEndingInstruction composes the instruction appended to every persona prompt from the enabled fragments,
+// a mode's length hint replaces the generic request to keep responses brief
+func getEndingInstruction(figure string, opts promptOptions, lengthHint string) string {
+	fragments := []string{
+		`Remember, you are ` + figure + `. Speak as if you are them, impersonating their language and tone, embody them to the fullest extent.`,
+	}
+	if opts.interactive {
+		fragments = append(fragments, `Be sure to ask the user questions and be as interactive as possible.`)
+	}
+	fragments = append(fragments,
+		`Your goal is to foster learning and deep thinking, and be sure to relate back to topics from your works or stories from your life.`,
+	)
+	if !opts.greeting {
+		fragments = append(fragments, `If this is your first message in the dialogue, take a sentence to introduce yourself.`)
+	}
+	if opts.personalize {
+		fragments = append(fragments, `Try to consistently relate your ideas and concepts back to the life of the individual. It is important to discuss and explain the more abstract topic itself, but making it relevant to the user is key to learning.`)
+	} else {
+		fragments = append(fragments, `Answer the user's question directly, without relating it to their personal life unless they ask.`)
+	}
+	if opts.concise {
+		if lengthHint != "" {
+			fragments = append(fragments, lengthHint)
+		} else {
+			fragments = append(fragments, `Please keep your responses relatively brief, as this is a dialogue.`)
+		}
+	}
+	return strings.Join(fragments, " ")
+}
+
+// defaultGenericTemplate is the default GENERIC_PROMPT_TEMPLATE for figures outside the catalog, and
+// the persona prompt of catalog figures in modes they have no template for
+const defaultGenericTemplate = `You are {figure}. Engage in a meaningful conversation with the user. {ending}`
+
+// Prompt part priorities, when the system prompt is over MAX_SYSTEM_PROMPT_CHARS the lowest
+// priority parts are dropped first. The persona is never dropped
+const (
+	priorityExtraInstructions = 10
+	priorityConversation      = 15
+	priorityCurrentDate       = 20
+	priorityWorks             = 30
+	priorityStyle             = 40
+	priorityDisclaimer        = 80
+	priorityReferenceFigure   = 85
+	priorityGreeting          = 90
+	priorityScene             = 95
+	priorityPersona           = 100
+)
+
+// promptPart is one component of the system prompt, its text includes the separator from the previous part
+type promptPart struct {
+	name     string
+	text     string
+	priority int
+}
+
+// systemPrompt is a system prompt assembled from prioritized parts
+type systemPrompt struct {
+	parts []promptPart
+}
+
+// add appends a part to the prompt
+func (p *systemPrompt) add(name string, text string, priority int) {
+	p.parts = append(p.parts, promptPart{name: name, text: text, priority: priority})
+}
+
+// render joins the parts, dropping the lowest priority parts (the latest first among equals) until
+// the prompt fits MAX_SYSTEM_PROMPT_CHARS, 0 means unlimited. Dropped parts are logged
+func (p systemPrompt) render(maxChars int) string {
+	kept := append([]promptPart(nil), p.parts...)
+
+	for maxChars > 0 && promptLength(kept) > maxChars {
+		drop := -1
+		for i, part := range kept {
+			if part.priority < priorityPersona && (drop == -1 || part.priority <= kept[drop].priority) {
+				drop = i
+			}
+		}
+		if drop == -1 {
+			fmt.Printf("System prompt is %d characters, over MAX_SYSTEM_PROMPT_CHARS (%d), with nothing left to drop\n", promptLength(kept), maxChars)
+			break
+		}
+		fmt.Printf("System prompt over MAX_SYSTEM_PROMPT_CHARS (%d), dropping %s\n", maxChars, kept[drop].name)
+		kept = append(kept[:drop], kept[drop+1:]...)
+	}
+
+	var b strings.Builder
+	for _, part := range kept {
+		b.WriteString(part.text)
+	}
+	return b.String()
+}
+
+// promptLength counts the characters of the parts
+func promptLength(parts []promptPart) int {
+	n := 0
+	for _, part := range parts {
+		n += utf8.RuneCountInString(part.text)
+	}
+	return n
+}
+
+// getSystemPrompt builds the system prompt for a figure and mode, in KID_SAFE_MODE with the
+// age-appropriateness instruction that is never dropped
+func getSystemPrompt(cfg *Config, figure string, mode Mode, topic string, opts promptOptions) *systemPrompt {
+	prompt := personaPrompt(cfg, figure, mode, topic, opts)
+	if cfg.KidSafeMode {
+		prompt.add("kid safe", kidSafeInstruction, priorityPersona)
+	}
+	return prompt
+}
+
+// personaPrompt builds the persona prompt for a figure and mode, figures outside the catalog get a generic persona
+func personaPrompt(cfg *Config, figure string, mode Mode, topic string, opts promptOptions) *systemPrompt {
+	prompt := &systemPrompt{}
+
+	f, ok := lookupFigure(figure)
+	if !ok {
+		endingInstruction := getEndingInstruction(figure, opts, "")
+		if mode == ModeScenario {
+			prompt.add("persona", fmt.Sprintf(`You are %s, offering advice based on your expertise and experiences. Provide thoughtful guidance to the user's situation or question. %s`, figure, endingInstruction), priorityPersona)
+			return prompt
+		}
+		prompt.add("persona", renderTemplate(cfg.GenericPromptTemplate, figure, topic, endingInstruction), priorityPersona)
+		return prompt
+	}
+
+	config, hasMode := f.Modes[mode]
+	endingInstruction := getEndingInstruction(figure, opts, config.LengthHint)
+
+	tmpl := config.Template
+	if !hasMode {
+		tmpl = f.GenericTemplate
+		if tmpl == "" {
+			tmpl = defaultGenericTemplate
+		}
+		fmt.Printf("No %q template for %s, using the generic template\n", mode, f.Name)
+	}
+	prompt.add("persona", renderTemplate(tmpl, f.Name, topic, endingInstruction), priorityPersona)
+	if f.Disclaimer != "" {
+		prompt.add("disclaimer", " When the user seeks personal advice, gently remind them, in your own voice: "+f.Disclaimer, priorityDisclaimer)
+	}
+	if len(f.Works) > 0 {
+		prompt.add("works", " "+worksInstruction(f.Works), priorityWorks)
+	}
+	if f.IncludeCurrentDate {
+		prompt.add("current date", " "+currentDateInstruction(time.Now(), cfg.Location), priorityCurrentDate)
+	}
+	return prompt
+}
+
+// worksInstruction lets the figure quote its own works, naming the work so the learner can look it up
+func worksInstruction(works []string) string {
+	quoted := make([]string, len(works))
+	for i, work := range works {
+		quoted[i] = `"` + work + `"`
+	}
+	return fmt.Sprintf("You may reference these works of yours: %s. When you quote or draw on one of them, name the work.", strings.Join(quoted, ", "))
+}
+
+// currentDateInstruction grounds the figure in today's date, framed as the user's present so
+// historical figures don't claim to live in it
+func currentDateInstruction(now time.Time, loc *time.Location) string {
+	return fmt.Sprintf("For the person you are speaking with, today's date is %s.", now.In(loc).Format("Monday, January 2, 2006"))
+}
+
+// renderTemplate fills in the placeholders of a prompt template
+func renderTemplate(tmpl string, figure string, topic string, ending string) string {
+	return strings.NewReplacer("{figure}", figure, "{topic}", topic, "{ending}", ending).Replace(tmpl)
+}
+
+// appendGreetingInstruction asks for a consistent opening on /api/start-dialogue, normal chat turns don't use it.
+// The prompt should be built with the greeting option so it doesn't also ask for an introduction
+func appendGreetingInstruction(cfg *Config, prompt *systemPrompt) {
+	prompt.add("greeting", " "+cfg.GreetingHint, priorityGreeting)
+}
+
+// scenarioMinWords is how long the first user turn must be to count as setting up a scenario itself
+const scenarioMinWords = 12
+
+// appendSceneSetting asks the figure to frame the scenario first in modes that require one, when the user
+// hasn't set it up: the figure hasn't spoken yet and there is no user turn or only a short one
+func appendSceneSetting(prompt *systemPrompt, figure string, mode Mode, messages []Message) {
+	if config, ok := lookupModeConfig(figure, mode); !ok || !config.RequiresScenario {
+		return
+	}
+	for _, msg := range messages {
+		if msg.Role == openai.ChatMessageRoleAssistant {
+			return
+		}
+	}
+	if first := firstUserMessage(messages); len(strings.Fields(first)) >= scenarioMinWords {
+		return
+	}
+	prompt.add("scene", " The user hasn't set up the scenario. Open by framing it in two or three vivid sentences: where and when we are, who the user is in it and what is at stake, then invite them to make their first move.", priorityScene)
+}
+
+// responseStyles are the formatting styles a figure or request may pick, mapped to their instruction
+var responseStyles = map[string]string{
+	"prose":    "Respond in clear, flowing prose.",
+	"dialogue": "Respond as a short scripted dialogue, giving the voices you bring in their own lines.",
+	"verse":    "Respond in a poetic, lyrical manner, in verse where it suits the thought.",
+}
+
+// appendStyle adds the response style instruction, the requested style overriding the figure's own.
+// The requested style must be one of responseStyles
+func appendStyle(prompt *systemPrompt, figure string, requested string) {
+	style := requested
+	if f, ok := lookupFigure(figure); ok && style == "" {
+		style = f.Style
+	}
+	if instruction, ok := responseStyles[style]; ok {
+		prompt.add("style", " "+instruction, priorityStyle)
+	}
+}
+
+// appendReflection asks the figure to end with a single reflective question on the topic. Callers turn off the
+// interactive instruction alongside it, so the figure isn't asked for questions twice. Since it stands in for
+// part of the persona's ending, it is kept at persona priority and never dropped by the prompt cap
+func appendReflection(prompt *systemPrompt, topic string) {
+	about := "the topic of this dialogue"
+	if topic != "" {
+		about = fmt.Sprintf(`"%s"`, topic)
+	}
+	prompt.add("reflection", fmt.Sprintf(" After your answer, end with exactly one open-ended reflective question about %s that invites the user to connect it to their own thinking, and ask no other questions.", about), priorityPersona)
+}
+
+// appendReferenceFigure asks the figure to discuss another figure's ideas in its own voice, when one was requested
+func appendReferenceFigure(prompt *systemPrompt, figure string, reference string) {
+	if reference == "" {
+		return
+	}
+	prompt.add("reference figure", fmt.Sprintf(" The user wants you to explain the ideas of %s. Present and discuss them in your own voice and from your own perspective as %s, saying where you agree or disagree, and don't speak as %s.", reference, figure, reference), priorityReferenceFigure)
+}
+
+// appendConversationInstruction adds the standing instruction of a conversation, which applies on every turn
+// unlike extraInstructions. It must already be sanitized
+func appendConversationInstruction(prompt *systemPrompt, instruction string) {
+	if instruction == "" {
+		return
+	}
+	prompt.add("conversation instruction", "\n\nStanding instructions for this whole conversation (follow them while staying in character): "+instruction, priorityConversation)
+}
+
+// appendExtraInstructions adds client-supplied instructions after the persona prompt,
+// sanitized and length-capped so they refine the persona rather than replace it
+func appendExtraInstructions(cfg *Config, prompt *systemPrompt, extra string) {
+	extra = sanitizeInstruction(extra, cfg.MaxExtraInstructionsChars)
+	if extra == "" {
+		return
+	}
+	prompt.add("extra instructions", "\n\nAdditional instructions for this response (follow them while staying in character): "+extra, priorityExtraInstructions)
+}
+
+// getSystemUpdate builds the marked system message that steers the conversation to a new focus,
+// returning an empty string when there is no update after sanitizing
+func getSystemUpdate(cfg *Config, figure string, update string) string {
+	update = sanitizeInstruction(update, cfg.MaxSystemUpdateChars)
+	if update == "" {
+		return ""
+	}
+	return fmt.Sprintf("[Focus update] The focus of this dialogue has shifted: %s Continue as %s, keeping your persona and the instructions above.", update, figure)
+}
+
+// sanitizeInstruction strips control characters and caps the instruction at maxLen characters
+func sanitizeInstruction(text string, maxLen int) string {
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return ' '
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.TrimSpace(text)
+
+	if runes := []rune(text); len(runes) > maxLen {
+		text = strings.TrimSpace(string(runes[:maxLen]))
+	}
+	return text
+}
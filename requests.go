@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader carries the ID the client needs to abort a stream
+const requestIDHeader = "X-Request-ID"
+
+// inflightStream is a running stream and the client that started it
+type inflightStream struct {
+	client string
+	cancel context.CancelFunc
+}
+
+// inflightRequests tracks the streams that are still running, keyed by request ID
+type inflightRequests struct {
+	mu      sync.Mutex
+	streams map[string]inflightStream
+}
+
+var inflight = &inflightRequests{streams: make(map[string]inflightStream)}
+
+// add registers the cancel function for a running stream started by the client
+func (r *inflightRequests) add(id string, client string, cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streams[id] = inflightStream{client: client, cancel: cancel}
+}
+
+// remove forgets a stream once it has ended
+func (r *inflightRequests) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.streams, id)
+}
+
+// cancel aborts a running stream, reporting whether it was found. Only the client that started
+// the stream may abort it, the request ID alone isn't enough since it is sent in every response
+func (r *inflightRequests) cancel(id string, client string) bool {
+	r.mu.Lock()
+	stream, ok := r.streams[id]
+	r.mu.Unlock()
+	if !ok || stream.client != client {
+		return false
+	}
+	stream.cancel()
+	return true
+}
+
+// requestID assigns every request a random ID and returns it in the response headers, it also
+// notes when the request started for the stream timings
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := newRequestID()
+		c.Set("requestID", id)
+		c.Set("requestStart", time.Now())
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// Helper function to generate a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// responseHeaders adds the RESPONSE_HEADERS to every response. They are set before the handler runs,
+// so headers a handler sets itself, like the SSE ones, take precedence
+func responseHeaders(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for name, value := range cfg.ResponseHeaders {
+			c.Header(name, value)
+		}
+		c.Next()
+	}
+}
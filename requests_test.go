@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInflightCancel(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		client   string
+		canceled bool
+	}{
+		{"same client", "stream", "192.0.2.1", true},
+		{"other client", "stream", "198.51.100.7", false},
+		{"unknown request", "other", "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			inflight.add("stream", "192.0.2.1", cancel)
+			defer inflight.remove("stream")
+
+			if got := inflight.cancel(tt.id, tt.client); got != tt.canceled {
+				t.Errorf("cancel(%q, %q) = %v, want %v", tt.id, tt.client, got, tt.canceled)
+			}
+			if canceled := ctx.Err() != nil; canceled != tt.canceled {
+				t.Errorf("stream canceled = %v, want %v", canceled, tt.canceled)
+			}
+		})
+	}
+}
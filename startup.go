@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// selfTest validates the OpenAI key with a models list call when STARTUP_SELFTEST is set,
+// refusing to start on failure when STARTUP_SELFTEST_STRICT is also set
+func selfTest(client openAIClient, cfg *Config) {
+	if !cfg.StartupSelfTest {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.StartupSelfTestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.ListModels(ctx); err != nil {
+		fmt.Println("Startup self-test failed, check OPENAI_API_KEY:", err)
+		if cfg.StartupSelfTestStrict {
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Printf("Startup self-test passed in %s\n", time.Since(start).Round(time.Millisecond))
+}
+
+// warmUp primes the connection to OpenAI with a 1-token completion when WARMUP_ON_START is set, so the
+// first user doesn't pay for DNS and the TLS handshake. It runs in the background and only logs failures
+func warmUp(client ChatClient, cfg *Config) {
+	if !cfg.WarmupOnStart {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.WarmupTimeout)
+		defer cancel()
+
+		start := time.Now()
+		_, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+			Model:     cfg.DefaultModel,
+			Messages:  []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ping"}},
+			MaxTokens: 1,
+		})
+		if err != nil {
+			fmt.Println("Warm-up completion failed:", err)
+			return
+		}
+		fmt.Printf("Warm-up completion took %s\n", time.Since(start).Round(time.Millisecond))
+	}()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minuteBucket counts the requests and errors of a single minute
+type minuteBucket struct {
+	minute   int64
+	requests int
+	errors   int
+}
+
+// requestStats aggregates request counters in memory, they reset on restart
+type requestStats struct {
+	mu           sync.Mutex
+	since        time.Time
+	total        int
+	byFigure     map[string]int
+	byMode       map[Mode]int
+	totalLatency time.Duration
+	tokens       int
+	// minutes holds the last hour, indexed by minute of the hour
+	minutes [60]minuteBucket
+
+	timeToFirstToken *histogram
+	tokensPerSecond  *histogram
+
+	// streamEnds counts relayed streams by how they ended, abandonedTokens estimates the tokens
+	// generated for streams the client abandoned
+	streamEnds      map[streamEnd]int
+	abandonedTokens int
+
+	// rateLimited counts the 429s answered, by the source of the limit
+	rateLimited map[string]int
+}
+
+var stats = &requestStats{
+	since:    time.Now(),
+	byFigure: make(map[string]int),
+	byMode:   make(map[Mode]int),
+
+	timeToFirstToken: newHistogram(0.25, 0.5, 1, 2, 4, 8),
+	tokensPerSecond:  newHistogram(2, 5, 10, 20, 40, 80),
+	streamEnds:       make(map[streamEnd]int),
+	rateLimited:      make(map[string]int),
+}
+
+// StatsSnapshot is the response of /api/admin/stats
+type StatsSnapshot struct {
+	Since               time.Time         `json:"since"`
+	TotalRequests       int               `json:"totalRequests"`
+	RequestsByFigure    map[string]int    `json:"requestsByFigure"`
+	RequestsByMode      map[Mode]int      `json:"requestsByMode"`
+	AverageLatencyMs    int64             `json:"averageLatencyMs"`
+	TotalTokens         int               `json:"totalTokens"`
+	RequestsLastHour    int               `json:"requestsLastHour"`
+	ErrorRateLastHour   float64           `json:"errorRateLastHour"`
+	TimeToFirstTokenSec HistogramSnapshot `json:"timeToFirstTokenSeconds"`
+	TokensPerSecond     HistogramSnapshot `json:"tokensPerSecond"`
+	Streams             StreamStats       `json:"streams"`
+	RateLimited         map[string]int    `json:"rateLimited"`
+}
+
+// StreamStats counts streams by how they ended. Abandoned streams were aborted or the client
+// disconnected, the abandonment rate is their share of all streams
+type StreamStats struct {
+	Completed       int     `json:"completed"`
+	Failed          int     `json:"failed"`
+	Abandoned       int     `json:"abandoned"`
+	Blocked         int     `json:"blocked"`
+	TimedOut        int     `json:"timedOut"`
+	AbandonmentRate float64 `json:"abandonmentRate"`
+	AbandonedTokens int     `json:"abandonedTokens"`
+}
+
+// record adds a finished request to the counters
+func (s *requestStats) record(figure string, mode Mode, latency time.Duration, tokens int, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+	if figure != "" {
+		s.byFigure[figure]++
+	}
+	s.byMode[mode]++
+	s.totalLatency += latency
+	s.tokens += tokens
+
+	minute := time.Now().Unix() / 60
+	bucket := &s.minutes[minute%60]
+	if bucket.minute != minute {
+		*bucket = minuteBucket{minute: minute}
+	}
+	bucket.requests++
+	if failed {
+		bucket.errors++
+	}
+}
+
+// recordStreamTiming adds the time to first token and throughput of a stream to the histograms
+func (s *requestStats) recordStreamTiming(ttft time.Duration, tokensPerSecond float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeToFirstToken.observe(ttft.Seconds())
+	if tokensPerSecond > 0 {
+		s.tokensPerSecond.observe(tokensPerSecond)
+	}
+}
+
+// recordStreamEnd counts how a stream ended, along with the tokens generated for it when abandoned
+func (s *requestStats) recordStreamEnd(end streamEnd, tokens int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamEnds[end]++
+	if end == streamAborted || end == streamDisconnected {
+		s.abandonedTokens += tokens
+	}
+}
+
+// recordRateLimit counts a 429 answered for a gateway or upstream limit
+func (s *requestStats) recordRateLimit(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited[source]++
+}
+
+// snapshot copies the counters for reporting
+func (s *requestStats) snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := StatsSnapshot{
+		Since:            s.since,
+		TotalRequests:    s.total,
+		RequestsByFigure: make(map[string]int, len(s.byFigure)),
+		RequestsByMode:   make(map[Mode]int, len(s.byMode)),
+		RateLimited:      map[string]int{rateLimitGateway: s.rateLimited[rateLimitGateway], rateLimitUpstream: s.rateLimited[rateLimitUpstream]},
+		TotalTokens:      s.tokens,
+
+		TimeToFirstTokenSec: s.timeToFirstToken.snapshot(),
+		TokensPerSecond:     s.tokensPerSecond.snapshot(),
+		Streams: StreamStats{
+			Completed:       s.streamEnds[streamComplete],
+			Failed:          s.streamEnds[streamFailed],
+			Abandoned:       s.streamEnds[streamAborted] + s.streamEnds[streamDisconnected],
+			Blocked:         s.streamEnds[streamBlocked],
+			TimedOut:        s.streamEnds[streamTimedOut],
+			AbandonedTokens: s.abandonedTokens,
+		},
+	}
+	if streams := snap.Streams.Completed + snap.Streams.Failed + snap.Streams.Abandoned + snap.Streams.Blocked + snap.Streams.TimedOut; streams > 0 {
+		snap.Streams.AbandonmentRate = float64(snap.Streams.Abandoned) / float64(streams)
+	}
+	for figure, n := range s.byFigure {
+		snap.RequestsByFigure[figure] = n
+	}
+	for mode, n := range s.byMode {
+		snap.RequestsByMode[mode] = n
+	}
+	if s.total > 0 {
+		snap.AverageLatencyMs = (s.totalLatency / time.Duration(s.total)).Milliseconds()
+	}
+
+	errors := 0
+	now := time.Now().Unix() / 60
+	for _, bucket := range s.minutes {
+		if now-bucket.minute < 60 {
+			snap.RequestsLastHour += bucket.requests
+			errors += bucket.errors
+		}
+	}
+	if snap.RequestsLastHour > 0 {
+		snap.ErrorRateLastHour = float64(errors) / float64(snap.RequestsLastHour)
+	}
+	return snap
+}
+
+// histogram counts observations into fixed buckets, the last bucket catches everything above the bounds
+type histogram struct {
+	bounds []float64
+	counts []int
+	count  int
+	sum    float64
+}
+
+// HistogramSnapshot reports a histogram's buckets, each counting the observations up to its bound
+type HistogramSnapshot struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   int               `json:"count"`
+	Sum     float64           `json:"sum"`
+}
+
+// HistogramBucket is one bucket of a histogram, the last one has no upper bound and reports le "+Inf"
+type HistogramBucket struct {
+	Le    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int, len(bounds)+1)}
+}
+
+// observe adds a value, the caller must hold the stats lock
+func (h *histogram) observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.counts[i]++
+	h.count++
+	h.sum += value
+}
+
+// snapshot copies the histogram, the caller must hold the stats lock
+func (h *histogram) snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{Count: h.count, Sum: h.sum}
+	for i, n := range h.counts {
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'f', -1, 64)
+		}
+		snap.Buckets = append(snap.Buckets, HistogramBucket{Le: le, Count: n})
+	}
+	return snap
+}
+
+// collectStats records every request of the route in the stats. Handlers tag the request with
+// its figure and mode through tagRequest, token usage comes from recordTokenUsage
+func collectStats() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		mode, _ := c.Get("mode")
+		m, _ := mode.(Mode)
+		failed := c.Writer.Status() >= http.StatusInternalServerError || c.GetBool("streamFailed")
+		stats.record(c.GetString("figure"), m, time.Since(start), c.GetInt("tokens"), failed)
+	}
+}
+
+// tagRequest tells collectStats which figure and mode a request was for
+func tagRequest(c *gin.Context, figure string, mode Mode) {
+	c.Set("figure", figure)
+	c.Set("mode", mode)
+}
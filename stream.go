@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// streamChunk carries a single result received from the upstream stream
+type streamChunk struct {
+	response openai.ChatCompletionStreamResponse
+	err      error
+}
+
+// MetaEvent is the first SSE event of a stream, telling the client who is speaking
+type MetaEvent struct {
+	Type           string `json:"type"`
+	Figure         string `json:"figure"`
+	Mode           Mode   `json:"mode"`
+	Model          string `json:"model"`
+	ConversationID string `json:"conversationId,omitempty"`
+	Disclaimer     string `json:"disclaimer,omitempty"`
+	// Names maps the message names sent upstream to the participants' display names
+	Names map[string]string `json:"names,omitempty"`
+	// HistoryDropped is how many of the oldest history messages were left out to fit the context window
+	HistoryDropped int `json:"historyDropped,omitempty"`
+}
+
+// streamOptions controls the optional extras sent along with a streamed completion
+type streamOptions struct {
+	// figure, mode and conversationID are reported to the client in the meta event
+	figure         string
+	mode           Mode
+	conversationID string
+
+	// includeSuggestions sends suggested follow-up questions once the completion has finished
+	includeSuggestions bool
+}
+
+// UsageEvent reports the token usage of a completion just before [DONE]
+type UsageEvent struct {
+	Type             string `json:"type"`
+	PromptTokens     int    `json:"promptTokens"`
+	CompletionTokens int    `json:"completionTokens"`
+	TotalTokens      int    `json:"totalTokens"`
+	// Estimated is set when OpenAI didn't report the usage and it was estimated from the text
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// streamResult is what relaying a completion produced
+type streamResult struct {
+	// content is the full assistant response, partial if the stream ended early
+	content string
+	// usage is reported by OpenAI in the final chunk when STREAM_USAGE is enabled, estimated is set when
+	// streamUsage had to fill it in, from generatedTokens, the estimated tokens of everything streamed
+	usage           *openai.Usage
+	estimated       bool
+	generatedTokens int
+	end             streamEnd
+	// firstDelta is when the first content arrived, zero if none did, and deltas counts the content chunks
+	firstDelta time.Time
+	deltas     int
+	// finishReason is why the upstream ended the completion: stop, length or content_filter
+	finishReason openai.FinishReason
+}
+
+// DoneEvent is sent just before [DONE] when the upstream finished the completion, so the client
+// can offer to continue a reply cut at the length limit or explain a content filter stop
+type DoneEvent struct {
+	Type         string              `json:"type"`
+	FinishReason openai.FinishReason `json:"finishReason,omitempty"`
+}
+
+// streamCompletion streams a chat completion to the client as server-sent events and returns the
+// full assistant response that was streamed along with its token usage when known
+func streamCompletion(c *gin.Context, cfg *Config, client ChatClient, req openai.ChatCompletionRequest, opts streamOptions) streamResult {
+	// No response may stream longer than the cap, however steadily the content arrives
+	ctx, cancel := withStreamDeadline(c.Request.Context(), cfg)
+	defer cancel()
+
+	// Let the client abort this stream through /api/chat/abort
+	id := c.GetString("requestID")
+	inflight.add(id, clientID(c), cancel)
+	defer inflight.remove(id)
+
+	// An identical request answered recently is replayed without calling OpenAI
+	cacheKey := responseCacheKey(c, cfg, req)
+	if cacheKey != "" {
+		if cached, ok := responseCache.get(cacheKey, cfg.ResponseCacheTTL); ok {
+			fmt.Println("Replaying cached response for request:", id)
+			defer startSSE(c, cfg)()
+			writeEvent(c, newMetaEvent(c, req, opts))
+			result := replayCachedResponse(c, cached)
+			if result.end == streamComplete {
+				writeEvent(c, DoneEvent{Type: "done", FinishReason: result.finishReason})
+				c.Writer.Write([]byte("data: [DONE]\n\n"))
+				c.Writer.Flush()
+			}
+			return result
+		}
+	}
+
+	// The daily token budget and the usage records need the usage of every completion
+	if includeUsage(cfg) {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
+	// The stream is opened before the event stream starts, so a failure is still answered with its own status
+	connectStart := time.Now()
+	stream, err := client.CreateChatCompletionStream(ctx, req)
+	connected := time.Now()
+	if err != nil {
+		fmt.Printf("Error creating stream after %dms: %v\n", connected.Sub(connectStart).Milliseconds(), err)
+		respondStreamError(c, ctx, err)
+		return streamResult{end: streamFailed}
+	}
+	defer stream.Close()
+
+	defer startSSE(c, cfg)()
+
+	writeEvent(c, newMetaEvent(c, req, opts))
+
+	result := streamUsage(cfg, req, relayStream(ctx, c, cfg, stream, id))
+	logCompletionTiming(id, req.Model, connected.Sub(connectStart), connected, result)
+	if result.end == streamDisconnected {
+		// What was generated is still charged, the client can't dodge the budget by hanging up
+		recordTokenUsage(c, cfg, opts.figure, req.Model, result.usage)
+		return result
+	}
+
+	// OpenAI occasionally finishes without any content, nudge the model once before giving up
+	if result.content == "" && result.end == streamComplete && cfg.RetryOnEmpty {
+		fmt.Println("Empty response, retrying once:", id)
+		retry := req
+		retry.Messages = append(append([]openai.ChatCompletionMessage{}, req.Messages...), openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: "Your previous reply was empty. Respond to the user now, staying in character.",
+		})
+
+		connectStart := time.Now()
+		retryStream, err := client.CreateChatCompletionStream(ctx, retry)
+		connected := time.Now()
+		if err != nil {
+			fmt.Println("Error creating retry stream:", err)
+			if streamExpired(ctx) {
+				stats.recordStreamEnd(streamTimedOut, 0)
+				writeEvent(c, gin.H{"type": "timeout"})
+				result.end = streamTimedOut
+			}
+		} else {
+			defer retryStream.Close()
+			empty := result
+			result = streamUsage(cfg, retry, relayStream(ctx, c, cfg, retryStream, id))
+			logCompletionTiming(id, retry.Model, connected.Sub(connectStart), connected, result)
+			result.usage = addUsage(empty.usage, result.usage)
+			result.estimated = result.estimated || empty.estimated
+			if result.end == streamDisconnected {
+				recordTokenUsage(c, cfg, opts.figure, req.Model, result.usage)
+				return result
+			}
+		}
+	}
+
+	if result.content == "" && result.end == streamComplete {
+		fmt.Println("Empty response for request:", id)
+		writeEvent(c, gin.H{"type": "error", "error": "empty_response"})
+	}
+
+	fmt.Printf("Streamed response for request %s (%d characters)\n", id, len(result.content))
+
+	if result.end == streamFailed {
+		c.Set("streamFailed", true)
+		writeInterrupted(c, cfg, result)
+	}
+
+	recordTokenUsage(c, cfg, opts.figure, req.Model, result.usage)
+	recordStreamTiming(c, result)
+
+	if result.usage != nil && cfg.StreamUsage {
+		writeEvent(c, UsageEvent{
+			Type:             "usage",
+			PromptTokens:     result.usage.PromptTokens,
+			CompletionTokens: result.usage.CompletionTokens,
+			TotalTokens:      result.usage.TotalTokens,
+			Estimated:        result.estimated,
+		})
+	}
+
+	flagged := checkOutput(c.Request.Context(), cfg, client, id, result.content)
+	if flagged {
+		writeEvent(c, gin.H{"type": "output_flagged"})
+	}
+
+	if cacheKey != "" && result.end == streamComplete && result.content != "" && !flagged {
+		responseCache.put(cacheKey, cachedResponse{content: result.content, finishReason: result.finishReason}, cfg.ResponseCacheMaxEntries)
+	}
+
+	// A stream that was cut short has no reply to suggest follow-ups to
+	if opts.includeSuggestions && result.end == streamComplete && result.content != "" {
+		conversation := append(req.Messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleAssistant,
+			Content: result.content,
+		})
+		items, err := generateSuggestions(c.Request.Context(), client, cfg.SuggestionsModel, conversation)
+		if err != nil {
+			fmt.Println("Error generating suggestions:", err)
+		} else {
+			writeEvent(c, SuggestionsEvent{Type: "suggestions", Items: items})
+		}
+	}
+
+	if result.end == streamComplete {
+		writeEvent(c, DoneEvent{Type: "done", FinishReason: result.finishReason})
+	}
+
+	c.Writer.Write([]byte("data: [DONE]\n\n"))
+	c.Writer.Flush()
+	return result
+}
+
+// newMetaEvent describes the completion about to be streamed
+func newMetaEvent(c *gin.Context, req openai.ChatCompletionRequest, opts streamOptions) MetaEvent {
+	return MetaEvent{
+		Type:           "meta",
+		Figure:         opts.figure,
+		Mode:           opts.mode,
+		Model:          req.Model,
+		ConversationID: opts.conversationID,
+		Disclaimer:     figureDisclaimer(opts.figure),
+		Names:          c.GetStringMapString("messageNames"),
+		HistoryDropped: c.GetInt("historyDropped"),
+	}
+}
+
+// startSSE sets the headers that enable server-sent events and flushes them, the returned
+// function must be called once the stream is finished. Connection is a hop-by-hop header that
+// HTTP/2 forbids, so it is only sent over HTTP/1; X-Accel-Buffering keeps nginx-style proxies,
+// which often terminate HTTP/2 in front of the app, from holding events back until their buffer fills
+func startSSE(c *gin.Context, cfg *Config) func() {
+	c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	c.Writer.Header().Set("Cache-Control", "no-cache, no-transform")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+	if c.Request.ProtoMajor == 1 {
+		c.Writer.Header().Set("Connection", "keep-alive")
+	}
+	done := compressStream(c, cfg.GzipSSE)
+	c.Writer.Flush()
+	return done
+}
+
+// streamEnd describes why relaying a stream stopped
+type streamEnd int
+
+const (
+	// streamComplete means the upstream finished the completion
+	streamComplete streamEnd = iota
+	// streamFailed means receiving from the upstream failed
+	streamFailed
+	// streamAborted means the stream was canceled through /api/chat/abort
+	streamAborted
+	// streamDisconnected means the client went away, nothing more may be written
+	streamDisconnected
+	// streamBlocked means the output matched STOP_PATTERNS and the stream was cut off
+	streamBlocked
+	// streamTimedOut means the stream ran past MAX_STREAM_DURATION_SECONDS and was cut off
+	streamTimedOut
+)
+
+// errStreamTooLong cancels a stream that ran past MAX_STREAM_DURATION_SECONDS
+var errStreamTooLong = errors.New("stream exceeded the maximum duration")
+
+// withStreamDeadline caps a request's streaming at MAX_STREAM_DURATION_SECONDS. It's created once per request,
+// so connecting, a retry and every panel turn all count against the same cap
+func withStreamDeadline(ctx context.Context, cfg *Config) (context.Context, context.CancelFunc) {
+	if cfg.MaxStreamDuration <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, cfg.MaxStreamDuration, errStreamTooLong)
+}
+
+// streamExpired reports whether a request's streaming was cut off by withStreamDeadline
+func streamExpired(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errStreamTooLong)
+}
+
+// respondStreamError answers a stream that couldn't be opened before the event stream started, with a 504
+// when the request ran out of time and as an upstream failure otherwise
+func respondStreamError(c *gin.Context, ctx context.Context, err error) {
+	if streamExpired(ctx) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "timeout"})
+		return
+	}
+	respondUpstreamError(c, err, "Error creating stream")
+}
+
+// relayStream forwards the deltas of an upstream stream to the client as SSE data events,
+// sending keep-alive comments until the first delta arrives, and returns the accumulated content.
+// ctx carries the request's withStreamDeadline, the stream times out when it expires
+func relayStream(ctx context.Context, c *gin.Context, cfg *Config, stream ChatStream, id string) streamResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Receive in the background so heartbeats can be sent while waiting for deltas
+	chunks := make(chan streamChunk)
+	go func() {
+		for {
+			response, err := stream.Recv()
+			select {
+			case chunks <- streamChunk{response: response, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			// A malformed chunk doesn't break the stream, the next Recv reads the following line
+			if err != nil && !isDecodeError(err) {
+				return
+			}
+		}
+	}()
+
+	// Keep proxies from closing the connection before the first token arrives
+	var heartbeat <-chan time.Time
+	if cfg.SSEHeartbeat > 0 {
+		ticker := time.NewTicker(cfg.SSEHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	// Accumulate the deltas so the complete response is known once the stream ends
+	var full strings.Builder
+	var usage *openai.Usage
+
+	// Isolated malformed chunks are skipped, only a run of them aborts the stream
+	maxDecodeErrors := cfg.StreamMaxDecodeErrors
+	decodeErrors := 0
+
+	// Deltas may be held back by the filters, the content is what was actually sent
+	filters := newDeltaChain(cfg)
+	send := func(text string) {
+		if text == "" {
+			return
+		}
+		full.WriteString(text)
+		writeDelta(c, text)
+	}
+
+	var firstDelta time.Time
+	deltas := 0
+	var finishReason openai.FinishReason
+	// The raw output, before the filters, is matched against STOP_PATTERNS including patterns spanning
+	// deltas, and is what the usage is estimated from when OpenAI doesn't report it
+	var raw strings.Builder
+	stops := newStopMatcher(cfg.StopPatterns)
+
+	done := func(end streamEnd) streamResult {
+		if end != streamDisconnected && end != streamBlocked {
+			send(filters.flush())
+		}
+
+		// Count abandoned streams and what they cost, each delta is about a token when no usage was reported
+		tokens := deltas
+		if usage != nil {
+			tokens = usage.CompletionTokens
+		}
+		if end == streamAborted || end == streamDisconnected {
+			fmt.Printf("Stream abandoned for request %s after about %d tokens\n", id, tokens)
+		}
+		stats.recordStreamEnd(end, tokens)
+		generated := estimateTokens(raw.String())
+		if end == streamBlocked {
+			// A blocked response is neither kept nor moderated, the client was told to discard it
+			return streamResult{usage: usage, generatedTokens: generated, end: end, firstDelta: firstDelta, deltas: deltas}
+		}
+		return streamResult{content: full.String(), usage: usage, generatedTokens: generated, end: end, firstDelta: firstDelta, deltas: deltas, finishReason: finishReason}
+	}
+
+	// Handle streaming response
+	for {
+		select {
+		case <-ctx.Done():
+			if clientGone(c) {
+				fmt.Println("Client disconnected, stopping stream:", id)
+				return done(streamDisconnected)
+			}
+			if streamExpired(ctx) {
+				fmt.Printf("Stream %s ran past %s, stopping it\n", id, cfg.MaxStreamDuration)
+				stream.Close()
+				result := done(streamTimedOut)
+				writeEvent(c, gin.H{"type": "timeout"})
+				return result
+			}
+			fmt.Println("Stream canceled:", id)
+			return done(streamAborted)
+		case <-heartbeat:
+			c.Writer.Write([]byte(": keep-alive\n\n"))
+			c.Writer.Flush()
+		case chunk := <-chunks:
+			if errors.Is(chunk.err, io.EOF) {
+				return done(streamComplete)
+			}
+			if isDecodeError(chunk.err) {
+				decodeErrors++
+				fmt.Printf("Skipping malformed chunk for request %s (%d in a row): %v\n", id, decodeErrors, chunk.err)
+				if decodeErrors < maxDecodeErrors {
+					continue
+				}
+				fmt.Println("Too many malformed chunks, stopping stream:", id)
+				return done(streamFailed)
+			}
+			if chunk.err != nil {
+				if clientGone(c) {
+					fmt.Println("Client disconnected, stopping stream:", id)
+					return done(streamDisconnected)
+				}
+				fmt.Println("Error receiving stream:", chunk.err)
+				return done(streamFailed)
+			}
+
+			decodeErrors = 0
+
+			// With usage enabled the final chunk carries the usage and no choices
+			if chunk.response.Usage != nil {
+				usage = chunk.response.Usage
+			}
+
+			if len(chunk.response.Choices) > 0 {
+				if reason := chunk.response.Choices[0].FinishReason; reason != "" {
+					finishReason = reason
+				}
+				content := chunk.response.Choices[0].Delta.Content
+				if content != "" {
+					if deltas == 0 {
+						firstDelta = time.Now()
+					}
+					deltas++
+					heartbeat = nil // Content is flowing, stop heartbeats
+
+					raw.WriteString(content)
+					if rule := stops.push(content); rule != "" {
+						fmt.Printf("Output matched stop pattern %q, blocking stream %s\n", rule, id)
+						stream.Close() // Stop the upstream generating now rather than when the handler returns
+						writeEvent(c, gin.H{"type": "blocked"})
+						return done(streamBlocked)
+					}
+					if text := filters.push(content); text != "" {
+						send(text)
+						time.Sleep(100 * time.Millisecond) // Artificial delay
+					}
+				}
+			}
+		}
+	}
+}
+
+// recordStreamTiming logs the time to first token and the throughput of a stream and adds them to the stats.
+// Throughput uses the completion tokens when usage is reported and counts each delta as a token otherwise
+func recordStreamTiming(c *gin.Context, result streamResult) {
+	if result.firstDelta.IsZero() {
+		return
+	}
+	ttft := result.firstDelta.Sub(c.GetTime("requestStart"))
+
+	tokens := result.deltas
+	if result.usage != nil {
+		tokens = result.usage.CompletionTokens
+	}
+	var tokensPerSecond float64
+	if elapsed := time.Since(result.firstDelta).Seconds(); elapsed > 0 {
+		tokensPerSecond = float64(tokens) / elapsed
+	}
+
+	fmt.Printf("Stream timing for request %s: first token after %dms, %.1f tokens/s\n", c.GetString("requestID"), ttft.Milliseconds(), tokensPerSecond)
+	stats.recordStreamTiming(ttft, tokensPerSecond)
+}
+
+// InterruptedEvent tells the client a reply was cut off by an upstream failure, as opposed to finishing cleanly
+type InterruptedEvent struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// writeInterrupted sends an interrupted event when a failed stream had already sent part of the reply,
+// so the client can close the partial reply with a notice
+func writeInterrupted(c *gin.Context, cfg *Config, result streamResult) {
+	if result.content == "" {
+		return
+	}
+	writeEvent(c, InterruptedEvent{Type: "interrupted", Message: cfg.InterruptedMessage})
+}
+
+// writeDelta sends a piece of the response as a data event
+func writeDelta(c *gin.Context, text string) {
+	c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", jsonString(text))))
+	c.Writer.Flush()
+}
+
+// writeEvent sends a JSON-encoded SSE data event
+func writeEvent(c *gin.Context, event any) {
+	b, err := jsonEncode(event)
+	if err != nil {
+		fmt.Println("Error encoding event:", err)
+		return
+	}
+	c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", b)))
+	c.Writer.Flush()
+}
+
+// clientGone reports whether the client has closed the connection, in which case nothing more should be written
+func clientGone(c *gin.Context) bool {
+	return c.Request.Context().Err() != nil
+}
+
+// isDecodeError reports whether a stream error came from decoding a malformed chunk rather than the connection
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// addUsage sums the usage of two completions, either of which may be unknown
+func addUsage(a, b *openai.Usage) *openai.Usage {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return &openai.Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// endpoint is a handler under test with a valid body for it
+type endpoint struct {
+	name    string
+	handler func(ChatClient, *Config) gin.HandlerFunc
+	body    string
+}
+
+// streamingEndpoints are the handlers that answer with an event stream
+var streamingEndpoints = []endpoint{
+	{"chat", chatHandler, `{"messages":[{"role":"user","content":"Hello"}],"mode":"socratic","selectedFigure":"Aristotle"}`},
+	{"start-dialogue", startDialogueHandler, `{"figure":"Aristotle","mode":"socratic","topic":"virtue"}`},
+	{"panel", panelHandler, `{"figures":["Aristotle","Confucius"],"topic":"virtue"}`},
+}
+
+// sseEvents returns the JSON data events of an event stream, [DONE] excluded, with deltas as plain strings
+func sseEvents(t *testing.T, body string) []any {
+	t.Helper()
+	var events []any
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var event any
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// eventTypes returns the types of the typed events in order, and the text of the deltas
+func eventTypes(events []any) (types []string, text string) {
+	for _, event := range events {
+		switch e := event.(type) {
+		case string:
+			text += e
+		case map[string]any:
+			types = append(types, e["type"].(string))
+		}
+	}
+	return types, text
+}
+
+func TestStreamingClientDisconnects(t *testing.T) {
+	cfg := testConfig(t)
+	for _, endpoint := range streamingEndpoints {
+		t.Run(endpoint.name, func(t *testing.T) {
+			client := &fakeChatClient{deltas: strings.Split("Greetings, I am a philosopher of Stagira and student of Plato", " "), chunkDelay: 50 * time.Millisecond}
+
+			// The client navigates away a few deltas into the greeting
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(300*time.Millisecond, cancel)
+			app := gin.New()
+			app.POST("/", requestID(), endpoint.handler(client, cfg))
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(endpoint.body)).WithContext(ctx)
+			w := httptest.NewRecorder()
+			start := time.Now()
+			app.ServeHTTP(w, r)
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("handler kept going for %s after the client left", elapsed)
+			}
+			_, text := eventTypes(sseEvents(t, w.Body.String()))
+			if text == "" || strings.HasSuffix(text, "Plato") {
+				t.Errorf("streamed %q, want the greeting cut short", text)
+			}
+			if strings.Contains(w.Body.String(), "[DONE]") {
+				t.Error("wrote [DONE] to a client that was gone")
+			}
+			if len(client.requests) != 1 {
+				t.Errorf("%d upstream requests, want no more after the disconnect", len(client.requests))
+			}
+		})
+	}
+}
+
+func TestRetryOnEmpty(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    string
+		streams  [][]string
+		requests int
+		text     string
+		events   []string
+	}{
+		{"retry succeeds", "true", [][]string{{}, {"Hello."}}, 2, "Hello.", []string{"meta", "done"}},
+		{"still empty", "true", [][]string{{}, {}}, 2, "", []string{"meta", "error", "done"}},
+		{"retry disabled", "false", [][]string{{}, {"Hello."}}, 1, "", []string{"meta", "error", "done"}},
+		{"not empty", "true", [][]string{{"Hello."}}, 1, "Hello.", []string{"meta", "done"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "RETRY_ON_EMPTY", tt.retry)
+			client := &fakeChatClient{streams: tt.streams}
+			w := serve(chatHandler(client, cfg), streamingEndpoints[0].body)
+
+			types, text := eventTypes(sseEvents(t, w.Body.String()))
+			if text != tt.text || strings.Join(types, ",") != strings.Join(tt.events, ",") {
+				t.Errorf("streamed %q with events %v, want %q with %v", text, types, tt.text, tt.events)
+			}
+			if tt.text == "" && !strings.Contains(w.Body.String(), `"error":"empty_response"`) {
+				t.Errorf("no empty_response error:\n%s", w.Body)
+			}
+			if len(client.requests) != tt.requests {
+				t.Fatalf("%d upstream requests, want %d", len(client.requests), tt.requests)
+			}
+			if tt.requests == 2 {
+				// The retry nudges the model after the original messages
+				messages := client.requests[1].Messages
+				nudge := messages[len(messages)-1]
+				if nudge.Role != openai.ChatMessageRoleSystem || !strings.Contains(nudge.Content, "previous reply was empty") {
+					t.Errorf("retry ends with %+v, want the nudge", nudge)
+				}
+				if len(messages) != len(client.requests[0].Messages)+1 {
+					t.Error("the retry doesn't resend the original messages")
+				}
+			}
+		})
+	}
+}
+
+func TestStreamUsageBeforeDone(t *testing.T) {
+	usage := &openai.Usage{PromptTokens: 42, CompletionTokens: 3, TotalTokens: 45}
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprint("STREAM_USAGE=", enabled), func(t *testing.T) {
+			cfg := testConfig(t, "STREAM_USAGE", fmt.Sprint(enabled))
+			client := &fakeChatClient{deltas: []string{"Hello."}}
+			if enabled {
+				client.usage = usage
+			}
+			w := serve(chatHandler(client, cfg), streamingEndpoints[0].body)
+
+			if got := client.lastRequest(t).StreamOptions != nil; got != enabled {
+				t.Errorf("usage requested = %v, want %v", got, enabled)
+			}
+			body := w.Body.String()
+			usageEvent := `data: {"type":"usage","promptTokens":42,"completionTokens":3,"totalTokens":45}`
+			if enabled != strings.Contains(body, usageEvent) {
+				t.Errorf("usage event sent = %v, want %v:\n%s", !enabled, enabled, body)
+			}
+			if enabled && strings.Index(body, usageEvent) > strings.Index(body, "[DONE]") {
+				t.Errorf("usage event after [DONE]:\n%s", body)
+			}
+		})
+	}
+
+	// Without a usage chunk the usage is estimated from the text, and flagged as such
+	cfg := testConfig(t, "STREAM_USAGE", "true")
+	w := serve(chatHandler(&fakeChatClient{deltas: []string{"Know thyself."}}, cfg), streamingEndpoints[0].body)
+	if !strings.Contains(w.Body.String(), `"type":"usage"`) || !strings.Contains(w.Body.String(), `"estimated":true`) {
+		t.Errorf("no estimated usage event:\n%s", w.Body)
+	}
+}
+
+func TestStreamFlushesOverHTTP2(t *testing.T) {
+	const chunkDelay = 150 * time.Millisecond
+	for _, endpoint := range streamingEndpoints {
+		t.Run(endpoint.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			client := &fakeChatClient{deltas: []string{"One.", " Two.", " Three."}, chunkDelay: chunkDelay}
+			app := gin.New()
+			app.POST("/", requestID(), endpoint.handler(client, cfg))
+			server := httptest.NewUnstartedServer(app)
+			server.EnableHTTP2 = true
+			server.StartTLS()
+			t.Cleanup(server.Close)
+
+			resp, err := server.Client().Post(server.URL, "application/json", strings.NewReader(endpoint.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.ProtoMajor != 2 {
+				t.Fatalf("served over %s, want HTTP/2", resp.Proto)
+			}
+			if resp.Header.Get("Connection") != "" || resp.Header.Get("X-Accel-Buffering") != "no" {
+				t.Errorf("headers = %v", resp.Header)
+			}
+
+			// Each delta arrives as it is produced, not all at once when the stream ends
+			var arrivals []time.Time
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), `data: "`) {
+					arrivals = append(arrivals, time.Now())
+				}
+			}
+			if len(arrivals) < 3 {
+				t.Fatalf("received %d deltas, want at least 3", len(arrivals))
+			}
+			if spread := arrivals[len(arrivals)-1].Sub(arrivals[0]); spread < chunkDelay {
+				t.Errorf("deltas arrived within %v of each other, want them flushed as they are produced", spread)
+			}
+		})
+	}
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  func(ChatClient, *Config) gin.HandlerFunc
+		body     string
+		client   *fakeChatClient
+		status   int
+		timedOut bool
+	}{
+		{
+			"slow stream", chatHandler, `{"message":"Hello","mode":"socratic","selectedFigure":"Aristotle"}`,
+			&fakeChatClient{deltas: strings.Split("Virtue is a habit and habits take time to form", " "), chunkDelay: 200 * time.Millisecond},
+			http.StatusOK, true,
+		},
+		{
+			"slow connect", chatHandler, `{"message":"Hello","mode":"socratic","selectedFigure":"Aristotle"}`,
+			&fakeChatClient{deltas: []string{"Hello."}, connectDelay: 2 * time.Second},
+			http.StatusGatewayTimeout, false,
+		},
+		{
+			// Connecting takes most of the cap, the stream itself would fit in it
+			"connect counts", chatHandler, `{"message":"Hello","mode":"socratic","selectedFigure":"Aristotle"}`,
+			&fakeChatClient{deltas: []string{"Virtue ", "is ", "a ", "habit."}, connectDelay: 700 * time.Millisecond, chunkDelay: 100 * time.Millisecond},
+			http.StatusOK, true,
+		},
+		{
+			// Each turn fits in the cap, the panel as a whole doesn't
+			"panel turns share the cap", panelHandler, `{"figures":["Aristotle","Confucius"],"topic":"virtue","rounds":2}`,
+			&fakeChatClient{deltas: []string{"Virtue ", "is a habit."}, chunkDelay: 150 * time.Millisecond},
+			http.StatusOK, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "MAX_STREAM_DURATION_SECONDS", "1")
+			start := time.Now()
+			w := serve(tt.handler(tt.client, cfg), tt.body)
+
+			if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+				t.Errorf("request took %s, past the 1s cap", elapsed)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if timedOut := strings.Contains(w.Body.String(), `{"type":"timeout"}`); timedOut != tt.timedOut {
+				t.Errorf("timeout event = %v, want %v:\n%s", timedOut, tt.timedOut, w.Body)
+			}
+			if tt.status == http.StatusOK && !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+				t.Error("stream doesn't end cleanly with [DONE]")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// suggestionsPrompt instructs the secondary model call that generates follow-up questions
+const suggestionsPrompt = `You suggest follow-up questions for an educational dialogue with a historical figure. Given the conversation so far, write 3 short questions the user might naturally ask next. Reply with only a JSON array of strings.`
+
+// SuggestionsEvent is the trailing SSE event carrying suggested follow-up questions
+type SuggestionsEvent struct {
+	Type  string   `json:"type"`
+	Items []string `json:"items"`
+}
+
+// generateSuggestions makes a small, cheap completion call for follow-up questions based on the recent conversation
+func generateSuggestions(ctx context.Context, client ChatClient, model string, messages []openai.ChatCompletionMessage) ([]string, error) {
+	// Only the latest turns matter and they keep the call cheap
+	if len(messages) > 6 {
+		messages = messages[len(messages)-6:]
+	}
+
+	var transcript strings.Builder
+	for _, msg := range messages {
+		if msg.Role == openai.ChatMessageRoleSystem {
+			continue
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+	}
+
+	return askForQuestions(ctx, client, model, suggestionsPrompt, transcript.String())
+}
+
+// openingQuestionsPrompt instructs the model call that suggests how to start a dialogue
+const openingQuestionsPrompt = `You help users start an educational dialogue with a historical figure. Given the figure, the style of dialogue and the topic, write 3 short opening questions the user could ask the figure. Reply with only a JSON array of strings.`
+
+// openingQuestionsCache remembers the questions generated for each figure/mode/topic combination
+var openingQuestionsCache = struct {
+	sync.Mutex
+	entries map[string][]string
+}{entries: make(map[string][]string)}
+
+// maxOpeningQuestionsEntries bounds the cache, it is cleared when full
+const maxOpeningQuestionsEntries = 1000
+
+// getOpeningQuestions returns cached opening questions for the combination or generates them with a cheap model call
+func getOpeningQuestions(ctx context.Context, client ChatClient, model string, figure string, mode Mode, topic string) ([]string, error) {
+	key := strings.ToLower(strings.Join([]string{figure, string(mode), topic}, "\x00"))
+
+	openingQuestionsCache.Lock()
+	questions, ok := openingQuestionsCache.entries[key]
+	openingQuestionsCache.Unlock()
+	if ok {
+		return questions, nil
+	}
+
+	request := fmt.Sprintf("Figure: %s\nStyle of dialogue: %s\nTopic: %s", figure, mode, topic)
+	questions, err := askForQuestions(ctx, client, model, openingQuestionsPrompt, request)
+	if err != nil {
+		return nil, err
+	}
+
+	openingQuestionsCache.Lock()
+	if len(openingQuestionsCache.entries) >= maxOpeningQuestionsEntries {
+		openingQuestionsCache.entries = make(map[string][]string)
+	}
+	openingQuestionsCache.entries[key] = questions
+	openingQuestionsCache.Unlock()
+	return questions, nil
+}
+
+// askForQuestions makes a small, cheap completion call that answers with a JSON array of up to 3 questions
+func askForQuestions(ctx context.Context, client ChatClient, model string, instructions string, content string) ([]string, error) {
+	req := openai.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: 120,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: instructions},
+			{Role: openai.ChatMessageRoleUser, Content: content},
+		},
+	}
+
+	resp, err := client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("no choices returned")
+	}
+
+	var items []string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(resp.Choices[0].Message.Content)), &items); err != nil {
+		return nil, fmt.Errorf("parsing questions: %w", err)
+	}
+	if len(items) > 3 {
+		items = items[:3]
+	}
+	return items, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// figureCounts counts the dialogues started with each figure, all-time and per hour for rolling windows
+type figureCounts struct {
+	mu      sync.Mutex
+	AllTime map[string]int `json:"allTime"`
+	// Hours maps the Unix hour to that hour's counts, hours older than the window are pruned
+	Hours map[int64]map[string]int `json:"hours"`
+}
+
+var trending = &figureCounts{AllTime: make(map[string]int), Hours: make(map[int64]map[string]int)}
+
+// TrendingFigure is one entry of /api/figures/trending
+type TrendingFigure struct {
+	Name      string `json:"name"`
+	Dialogues int    `json:"dialogues"`
+}
+
+// add counts a dialogue started with the figure
+func (t *figureCounts) add(figure string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hour := time.Now().Unix() / 3600
+	if t.Hours[hour] == nil {
+		t.Hours[hour] = make(map[string]int)
+	}
+	t.Hours[hour][figure]++
+	t.AllTime[figure]++
+}
+
+// ranked returns the figures by dialogues started, over the last window or all-time when window is 0
+func (t *figureCounts) ranked(window time.Duration) []TrendingFigure {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := t.AllTime
+	if window > 0 {
+		counts = make(map[string]int)
+		since := time.Now().Add(-window).Unix() / 3600
+		for hour, hourCounts := range t.Hours {
+			if hour <= since {
+				continue
+			}
+			for figure, n := range hourCounts {
+				counts[figure] += n
+			}
+		}
+	}
+
+	figures := make([]TrendingFigure, 0, len(counts))
+	for name, n := range counts {
+		figures = append(figures, TrendingFigure{Name: name, Dialogues: n})
+	}
+	sort.Slice(figures, func(i, j int) bool {
+		if figures[i].Dialogues != figures[j].Dialogues {
+			return figures[i].Dialogues > figures[j].Dialogues
+		}
+		return figures[i].Name < figures[j].Name
+	})
+	return figures
+}
+
+// prune drops the hourly counts that have left the window, all-time counts are kept
+func (t *figureCounts) prune(window time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	since := time.Now().Add(-window).Unix() / 3600
+	for hour := range t.Hours {
+		if hour <= since {
+			delete(t.Hours, hour)
+		}
+	}
+}
+
+// loadTrending restores the counts flushed to TRENDING_FILE by an earlier run
+func loadTrending(cfg *Config) {
+	if cfg.TrendingFile == "" {
+		return
+	}
+	data, err := os.ReadFile(cfg.TrendingFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		trending.mu.Lock()
+		err = json.Unmarshal(data, trending)
+		trending.mu.Unlock()
+	}
+	if err != nil {
+		fmt.Println("Error loading trending figures, starting from zero:", err)
+	}
+	if err != nil || trending.AllTime == nil || trending.Hours == nil {
+		trending.AllTime = make(map[string]int)
+		trending.Hours = make(map[int64]map[string]int)
+	}
+}
+
+// flushTrending writes the counts to TRENDING_FILE every TRENDING_FLUSH_SECONDS, so they survive restarts
+func flushTrending(cfg *Config) {
+	if cfg.TrendingFile == "" {
+		return
+	}
+	for range time.Tick(cfg.TrendingFlushInterval) {
+		// A window of a week at least keeps enough hours to switch between windows across a restart
+		trending.prune(max(cfg.TrendingWindow, 7*24*time.Hour))
+
+		trending.mu.Lock()
+		data, err := json.Marshal(trending)
+		trending.mu.Unlock()
+		if err == nil {
+			err = os.WriteFile(cfg.TrendingFile, data, 0o644)
+		}
+		if err != nil {
+			fmt.Println("Error flushing trending figures:", err)
+		}
+	}
+}
+
+// trendingHandler handles /api/figures/trending, the visible figures with the most dialogues started over
+// TRENDING_WINDOW_HOURS, or all-time when it is 0. ?limit= caps the list, 10 by default
+func trendingHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+		if err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+
+		figures := []TrendingFigure{}
+		for _, f := range trending.ranked(cfg.TrendingWindow) {
+			if catalog, ok := lookupFigure(f.Name); ok && catalog.visible(cfg.Env) && len(figures) < limit {
+				figures = append(figures, f)
+			}
+		}
+
+		window := "all"
+		if cfg.TrendingWindow > 0 {
+			window = cfg.TrendingWindow.String()
+		}
+		c.JSON(http.StatusOK, gin.H{"figures": figures, "window": window})
+	}
+}
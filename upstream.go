@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// isInsufficientQuota reports whether OpenAI rejected a request because the account is out of quota
+func isInsufficientQuota(err error) bool {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Type == "insufficient_quota" || apiErr.Code == "insufficient_quota"
+}
+
+// Rate limit sources, so clients back off against the right limit
+const (
+	// rateLimitGateway is one of our own limits, like the daily token budget
+	rateLimitGateway = "gateway"
+	// rateLimitUpstream is OpenAI's rate limit
+	rateLimitUpstream = "upstream"
+)
+
+// defaultUpstreamRetryAfter is the wait suggested after an OpenAI 429 that doesn't say how long to wait
+const defaultUpstreamRetryAfter = 10 * time.Second
+
+// retryAfterPattern finds the wait in OpenAI's rate limit messages, e.g. "Please try again in 1.5s" or "in 120ms"
+var retryAfterPattern = regexp.MustCompile(`try again in ([0-9.]+)(ms|s)\b`)
+
+// upstreamRateLimit returns how long to wait when err is an OpenAI 429, false for any other error
+func upstreamRateLimit(err error) (time.Duration, bool) {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	match := retryAfterPattern.FindStringSubmatch(apiErr.Message)
+	if match == nil {
+		return defaultUpstreamRetryAfter, true
+	}
+	wait, err := time.ParseDuration(match[1] + match[2])
+	if err != nil {
+		return defaultUpstreamRetryAfter, true
+	}
+	return wait, true
+}
+
+// respondUpstreamError answers a failed OpenAI call. An exhausted quota is a billing problem the
+// operator must fix, so it is logged loudly and reported to the client as a generic 503 without
+// billing details. OpenAI's rate limit is passed on as an upstream 429, other errors get a 500
+// with the given message
+func respondUpstreamError(c *gin.Context, err error, message string) {
+	if isInsufficientQuota(err) {
+		fmt.Println("!!! OPENAI QUOTA EXHAUSTED: requests will fail until billing is fixed:", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": gin.H{"code": "service_unavailable", "message": "temporarily unavailable"}})
+		return
+	}
+	if wait, ok := upstreamRateLimit(err); ok {
+		respondRateLimited(c, rateLimitUpstream, "upstream_rate_limited", wait)
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// ErrorEvent reports a failure in an event stream that has already started
+type ErrorEvent struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+	// RetryAfter is the wait in seconds after a rate limit
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// upstreamErrorEvent describes a failed OpenAI call as an error event, for failures once the event stream
+// has started and a status can no longer be sent. The error codes match respondUpstreamError's
+func upstreamErrorEvent(err error) ErrorEvent {
+	event := ErrorEvent{Type: "error", Error: "upstream_error"}
+	if isInsufficientQuota(err) {
+		fmt.Println("!!! OPENAI QUOTA EXHAUSTED: requests will fail until billing is fixed:", err)
+		event.Error = "service_unavailable"
+	} else if wait, ok := upstreamRateLimit(err); ok {
+		stats.recordRateLimit(rateLimitUpstream)
+		event.Error = "upstream_rate_limited"
+		event.RetryAfter = max(int(math.Ceil(wait.Seconds())), 1)
+	}
+	return event
+}
+
+// respondRateLimited answers with a 429 naming the limit's source and code, with Retry-After in whole
+// seconds, and counts it in the stats by source
+func respondRateLimited(c *gin.Context, source string, code string, wait time.Duration) {
+	seconds := max(int(math.Ceil(wait.Seconds())), 1)
+	fmt.Printf("Rate limited by %s (%s) for request %s, retry after %ds\n", source, code, c.GetString("requestID"), seconds)
+	stats.recordRateLimit(source)
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": code, "source": source, "retryAfter": seconds})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestUpstreamErrors(t *testing.T) {
+	cfg := testConfig(t)
+	candidates := endpoint{"candidates", chatHandler, `{"messages":[{"role":"user","content":"Hello"}],"mode":"socratic","selectedFigure":"Aristotle","candidates":2}`}
+	endpoints := append([]endpoint{candidates}, streamingEndpoints...)
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"generic failure", errors.New("connection reset"), http.StatusInternalServerError, ""},
+		{"insufficient quota", &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Code: "insufficient_quota", Message: "You exceeded your current quota"}, http.StatusServiceUnavailable, "service_unavailable"},
+		{"upstream rate limit", &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "Rate limit reached. Please try again in 2.5s."}, http.StatusTooManyRequests, "upstream_rate_limited"},
+	}
+	for _, tt := range tests {
+		for _, e := range endpoints {
+			t.Run(tt.name+"/"+e.name, func(t *testing.T) {
+				w := serve(e.handler(&fakeChatClient{err: tt.err}, cfg), e.body)
+
+				// The upstream call fails before any event is sent, so the status is still the error's
+				if w.Code != tt.status {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+				}
+				if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+					t.Errorf("Content-Type = %q, want JSON", ct)
+				}
+				if body := w.Body.String(); !strings.Contains(body, tt.code) || strings.Contains(body, "quota") {
+					t.Errorf("body = %s, want %q without billing details", body, tt.code)
+				}
+				if tt.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "3" {
+					t.Errorf("Retry-After = %q, want 3", w.Header().Get("Retry-After"))
+				}
+			})
+		}
+	}
+}
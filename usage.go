@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// usageDateFormat is the format of usage record days and the from and to parameters of /api/admin/usage.csv
+const usageDateFormat = "2006-01-02"
+
+// modelPrice is what a model costs in USD per million prompt and completion tokens
+type modelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// defaultModelPrices are OpenAI's list prices for the default ALLOWED_MODELS, MODEL_PRICES overrides them
+var defaultModelPrices = map[string]modelPrice{
+	"gpt-3.5-turbo": {Prompt: 0.50, Completion: 1.50},
+	"gpt-4o-mini":   {Prompt: 0.15, Completion: 0.60},
+	"gpt-4o":        {Prompt: 2.50, Completion: 10.00},
+}
+
+// usageRecord is the tokens used on one day (UTC) for one figure, mode and model
+type usageRecord struct {
+	Date             string `json:"date"`
+	Figure           string `json:"figure"`
+	Mode             Mode   `json:"mode"`
+	Model            string `json:"model"`
+	PromptTokens     int    `json:"promptTokens"`
+	CompletionTokens int    `json:"completionTokens"`
+}
+
+// usageStore accumulates the token usage of every completion, kept when USAGE_FILE is set
+type usageStore struct {
+	mu sync.Mutex
+	// Records are keyed by date, figure, mode and model
+	Records map[string]*usageRecord `json:"records"`
+}
+
+var usageLog = &usageStore{Records: make(map[string]*usageRecord)}
+
+// add charges a completion's usage to today's record for the figure, mode and model
+func (s *usageStore) add(figure string, mode Mode, model string, usage openai.Usage) {
+	date := time.Now().UTC().Format(usageDateFormat)
+	key := strings.Join([]string{date, figure, string(mode), model}, "|")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.Records[key]
+	if record == nil {
+		record = &usageRecord{Date: date, Figure: figure, Mode: mode, Model: model}
+		s.Records[key] = record
+	}
+	record.PromptTokens += usage.PromptTokens
+	record.CompletionTokens += usage.CompletionTokens
+}
+
+// between returns the records from the from day to the to day inclusive, ordered by day, figure, mode and model
+func (s *usageStore) between(from string, to string) []usageRecord {
+	s.mu.Lock()
+	var records []usageRecord
+	for _, record := range s.Records {
+		if record.Date >= from && record.Date <= to {
+			records = append(records, *record)
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+		if a.Figure != b.Figure {
+			return a.Figure < b.Figure
+		}
+		if a.Mode != b.Mode {
+			return a.Mode < b.Mode
+		}
+		return a.Model < b.Model
+	})
+	return records
+}
+
+// recordUsage adds a completion's usage to the usage store when USAGE_FILE is set
+func recordUsage(cfg *Config, figure string, mode Mode, model string, usage *openai.Usage) {
+	if cfg.UsageFile == "" || usage == nil {
+		return
+	}
+	usageLog.add(figure, mode, model, *usage)
+}
+
+// estimatedCost prices the record's tokens, ok is false for models without a price
+func estimatedCost(cfg *Config, record usageRecord) (cost float64, ok bool) {
+	price, ok := cfg.ModelPrices[record.Model]
+	if !ok {
+		return 0, false
+	}
+	return (float64(record.PromptTokens)*price.Prompt + float64(record.CompletionTokens)*price.Completion) / 1e6, true
+}
+
+// loadUsage restores the records flushed to USAGE_FILE by an earlier run
+func loadUsage(cfg *Config) {
+	if cfg.UsageFile == "" {
+		return
+	}
+	data, err := os.ReadFile(cfg.UsageFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		usageLog.mu.Lock()
+		err = json.Unmarshal(data, usageLog)
+		usageLog.mu.Unlock()
+	}
+	if err != nil {
+		fmt.Println("Error loading usage records, starting from zero:", err)
+	}
+	if err != nil || usageLog.Records == nil {
+		usageLog.Records = make(map[string]*usageRecord)
+	}
+}
+
+// flushUsage writes the records to USAGE_FILE every USAGE_FLUSH_SECONDS, so they survive restarts
+func flushUsage(cfg *Config) {
+	if cfg.UsageFile == "" {
+		return
+	}
+	for range time.Tick(cfg.UsageFlushInterval) {
+		usageLog.mu.Lock()
+		data, err := json.Marshal(usageLog)
+		usageLog.mu.Unlock()
+		if err == nil {
+			err = os.WriteFile(cfg.UsageFile, data, 0o644)
+		}
+		if err != nil {
+			fmt.Println("Error flushing usage records:", err)
+		}
+	}
+}
+
+// csvText makes a client-supplied value, like a custom figure name, safe to open in a spreadsheet: a cell
+// starting like a formula is prefixed with a quote so it's shown as text instead of evaluated
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// usageCSVHandler handles /api/admin/usage.csv, the token usage per day, figure, mode and model between
+// ?from= and ?to= (YYYY-MM-DD, inclusive) with its estimated cost. The range defaults to the current month
+func usageCSVHandler(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.UsageFile == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Usage is not recorded, set USAGE_FILE"})
+			return
+		}
+
+		now := time.Now().UTC()
+		from := c.DefaultQuery("from", now.Format("2006-01")+"-01")
+		to := c.DefaultQuery("to", now.Format(usageDateFormat))
+		if _, err := time.Parse(usageDateFormat, from); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+			return
+		}
+		if _, err := time.Parse(usageDateFormat, to); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+			return
+		}
+
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s-%s.csv"`, from, to))
+		c.Status(http.StatusOK)
+
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"date", "figure", "mode", "model", "prompt_tokens", "completion_tokens", "estimated_cost_usd"})
+		for _, record := range usageLog.between(from, to) {
+			// A model without a price leaves the cost empty rather than reporting it as free
+			cost := ""
+			if amount, ok := estimatedCost(cfg, record); ok {
+				cost = strconv.FormatFloat(amount, 'f', 6, 64)
+			}
+			w.Write([]string{
+				record.Date,
+				csvText(record.Figure),
+				csvText(string(record.Mode)),
+				csvText(record.Model),
+				strconv.Itoa(record.PromptTokens),
+				strconv.Itoa(record.CompletionTokens),
+				cost,
+			})
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestCSVText(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Aristotle", "Aristotle"},
+		{"", ""},
+		{`=HYPERLINK("http://evil.example","click")`, `'=HYPERLINK("http://evil.example","click")`},
+		{"+1+1", "'+1+1"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1:A9)", "'@SUM(A1:A9)"},
+		{"\t=1+1", "'\t=1+1"},
+		{"Marie Curie = genius", "Marie Curie = genius"},
+	}
+	for _, tt := range tests {
+		if got := csvText(tt.value); got != tt.want {
+			t.Errorf("csvText(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUsageCSVNeutralizesFormulas(t *testing.T) {
+	cfg := testConfig(t, "USAGE_FILE", filepath.Join(t.TempDir(), "usage.json"))
+	recordUsage(cfg, `=HYPERLINK("http://evil.example","Aristotle")`, ModeSocratic, "gpt-3.5-turbo", &openai.Usage{PromptTokens: 100, CompletionTokens: 50})
+
+	w := serveRoute(http.MethodGet, "/usage.csv", "/usage.csv", "192.0.2.1", usageCSVHandler(cfg), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows[1:] {
+		if strings.Contains(row[1], "HYPERLINK") {
+			if row[1] != `'=HYPERLINK("http://evil.example","Aristotle")` {
+				t.Errorf("figure cell = %q, want it quoted", row[1])
+			}
+			return
+		}
+	}
+	t.Errorf("no row for the recorded usage:\n%s", w.Body)
+}
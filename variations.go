@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// variationMarker matches the numbering or bullet a model may put before a variation despite being asked not to
+var variationMarker = regexp.MustCompile(`^(?:\d+[.):]|[-*•])\s*`)
+
+// appendVariations tells the model its reply is one of n written side by side, so each choice reaches for
+// its own angle instead of the most obvious one. It keeps the reply to the single line a variation is made
+// of, so it is never dropped
+func appendVariations(prompt *systemPrompt, n int) {
+	prompt.add("variations", fmt.Sprintf(" Your reply is one of %d versions written for the same message, so skip the most obvious take and find a genuinely different angle, joke or wordplay. Write only that one version on a single line, with no numbering, bullets or commentary.", n), priorityPersona)
+}
+
+// respondWithVariations runs a non-streaming completion with n choices and returns them as a list of
+// variations. Each choice is one variation within the figure's own max_tokens, so the request still fits
+// the context window and response budget it was fitted to
+func respondWithVariations(c *gin.Context, cfg *Config, client ChatClient, req openai.ChatCompletionRequest, n int) {
+	req.Stream = false
+	req.StreamOptions = nil
+	req.N = n
+
+	resp, err := client.CreateChatCompletion(c.Request.Context(), req)
+	if err != nil {
+		fmt.Println("Error creating completion:", err)
+		respondUpstreamError(c, err, "Error generating response")
+		return
+	}
+	recordTokenUsage(c, cfg, c.GetString("figure"), req.Model, &resp.Usage)
+
+	// Blocked choices are left out, the response is only blocked when every choice was
+	var replies []string
+	blocked, flagged := len(resp.Choices) > 0, false
+	for _, choice := range resp.Choices {
+		content, choiceBlocked, choiceFlagged := reviewReply(c.Request.Context(), cfg, client, c.GetString("requestID"), choice.Message.Content)
+		flagged = flagged || choiceFlagged
+		if choiceBlocked {
+			continue
+		}
+		blocked = false
+		replies = append(replies, content)
+	}
+	if blocked {
+		c.JSON(http.StatusOK, gin.H{"variations": []string{}, "blocked": true, "usage": resp.Usage})
+		return
+	}
+
+	variations := collectVariations(replies, n)
+	if len(variations) < n {
+		fmt.Printf("Asked for %d variations, got %d for request %s\n", n, len(variations), c.GetString("requestID"))
+	}
+	c.JSON(http.StatusOK, gin.H{"variations": variations, "flagged": flagged, "usage": resp.Usage})
+}
+
+// collectVariations turns the choices into variations, each the first non-blank line of its choice without a
+// list marker or wrapping quotes, dropping repeats and keeping at most n
+func collectVariations(replies []string, n int) []string {
+	variations := []string{}
+	seen := make(map[string]bool)
+	for _, reply := range replies {
+		var line string
+		for _, l := range strings.Split(reply, "\n") {
+			if line = strings.TrimSpace(variationMarker.ReplaceAllString(strings.TrimSpace(l), "")); line != "" {
+				break
+			}
+		}
+		line = strings.TrimSpace(strings.Trim(line, `"“”`))
+		key := strings.ToLower(line)
+		if line == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		variations = append(variations, line)
+		if len(variations) == n {
+			break
+		}
+	}
+	return variations
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCollectVariations(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []string
+		n       int
+		want    []string
+	}{
+		{"plain", []string{"Tacos fix everything", "Hug your cactus"}, 2, []string{"Tacos fix everything", "Hug your cactus"}},
+		{"markers and quotes", []string{`1. "Tacos fix everything"`, "- “Hug your cactus”"}, 2, []string{"Tacos fix everything", "Hug your cactus"}},
+		{"first line of a choice", []string{"\n  Tacos fix everything\nHere's another one"}, 1, []string{"Tacos fix everything"}},
+		{"repeats dropped", []string{"Tacos fix everything", "tacos fix everything", "Hug your cactus"}, 3, []string{"Tacos fix everything", "Hug your cactus"}},
+		{"at most n", []string{"One", "Two", "Three"}, 2, []string{"One", "Two"}},
+		{"blank choices", []string{"", "  "}, 2, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := collectVariations(tt.replies, tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("collectVariations = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatVariations(t *testing.T) {
+	cfg := testConfig(t)
+	client := &fakeChatClient{replies: []string{"Tacos fix everything", "Hug your cactus", "Siesta is self care"}}
+
+	w := serve(chatHandler(client, cfg), `{"message":"Monday again","mode":"humor","selectedFigure":"El Arroyo Sign","variations":3}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Variations []string `json:"variations"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Variations) != 3 {
+		t.Errorf("variations = %q, want 3", resp.Variations)
+	}
+
+	// One choice per variation, each within the figure's response budget that the context was fitted to
+	req := client.lastRequest(t)
+	if req.N != 3 || req.Stream {
+		t.Errorf("request N = %d, stream = %v, want 3 choices without streaming", req.N, req.Stream)
+	}
+	f, _ := lookupFigure("El Arroyo Sign")
+	if req.MaxTokens == 0 || req.MaxTokens > f.ResponseTokenBudget {
+		t.Errorf("max_tokens = %d, want at most the %d token budget", req.MaxTokens, f.ResponseTokenBudget)
+	}
+}
+
+func TestChatVariationsBlocked(t *testing.T) {
+	cfg := testConfig(t, "STOP_PATTERNS", "cactus")
+	tests := []struct {
+		name    string
+		replies []string
+		want    string
+	}{
+		{"some blocked", []string{"Tacos fix everything", "Hug your cactus"}, `"variations":["Tacos fix everything"]`},
+		{"all blocked", []string{"Hug your cactus", "Water your cactus"}, `"blocked":true`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(chatHandler(&fakeChatClient{replies: tt.replies}, cfg), `{"message":"Monday again","mode":"humor","selectedFigure":"El Arroyo Sign","variations":2}`)
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("status = %d, body = %s, want %s", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}